@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+type AuditEventResponse struct {
+	ID        int    `json:"id"`
+	Event     string `json:"event"`
+	UserID    *int   `json:"user_id"` // nil for events without a known user, e.g. logins with an unknown username
+	IP        string `json:"ip"`
+	Details   string `json:"details"`
+	CreatedAt string `json:"created_at"`
+}
+
+type AuditEventsListResponse struct {
+	Events []AuditEventResponse `json:"events"`
+	Total  int                  `json:"total"`
+}
+
+// Log a security relevant event and record it in the audit trail. The IP is
+// empty for events not caused by a request.
+func recordAuditEvent(event string, userID int, ip string, details string) {
+	log.Warnf("Security event %s for user %d from %q: %s", event, userID, ip, details)
+
+	var user sql.NullInt64
+	if userID != 0 {
+		user = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO audit_events (event, user_id, ip, details)
+		VALUES (?, ?, ?, ?)`, event, user, ip, details)
+	if err != nil {
+		log.Warnf("Failed to record security event %s: %v", event, err)
+	}
+}
+
+// Get audit events, newest first, optionally only those of a user or of an event type
+func getAuditEvents(userID int, event string, limit, offset int) ([]AuditEventResponse, int, error) {
+	where := "WHERE (? = 0 OR user_id = ?) AND (? = '' OR event = ?)"
+	args := []interface{}{userID, userID, event, event}
+
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM audit_events "+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, event, user_id, ip, details, created_at
+		FROM audit_events `+where+`
+		ORDER BY id DESC
+		LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	events := []AuditEventResponse{}
+	for rows.Next() {
+		var event AuditEventResponse
+		var user sql.NullInt64
+		if err := rows.Scan(&event.ID, &event.Event, &user, &event.IP, &event.Details, &event.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		if user.Valid {
+			id := int(user.Int64)
+			event.UserID = &id
+		}
+		events = append(events, event)
+	}
+	return events, total, rows.Err()
+}
+
+// GET /admin/audit-events
+// Get the audit trail (admin only)
+// @Summary		Get audit events
+// @Description	Retrieve a paginated list of security events such as failed logins and account lockouts, newest first (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			user_id	query		int		false	"Only events of this user"
+// @Param			event	query		string	false	"Only events of this type, e.g. login_failed"
+// @Param			limit	query		int		false	"Number of events to return"	minimum(1)	default(50)
+// @Param			offset	query		int		false	"Number of events to skip"		minimum(0)	default(0)
+// @Success		200		{object}	AuditEventsListResponse
+// @Failure		400		{object}	ErrorResponse	"Invalid user ID"
+// @Failure		500		{object}	ErrorResponse	"Failed to fetch audit events"
+// @Router			/admin/audit-events [GET]
+func getAuditEventsHandler(c *fiber.Ctx) error {
+	limit := 50
+	offset := 0
+
+	if l := c.Query("limit"); l != "" {
+		if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 {
+			limit = parsed
+		}
+	}
+
+	if o := c.Query("offset"); o != "" {
+		if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+			offset = parsed
+		}
+	}
+
+	userID := 0
+	if u := c.Query("user_id"); u != "" {
+		parsed, err := strconv.Atoi(u)
+		if err != nil || parsed <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+				Error: "Invalid user ID",
+			})
+		}
+		userID = parsed
+	}
+
+	events, total, err := getAuditEvents(userID, c.Query("event"), limit, offset)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch audit events",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(AuditEventsListResponse{
+		Events: events,
+		Total:  total,
+	})
+}
@@ -1,6 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
 	"strings"
 	"time"
 
@@ -8,57 +15,134 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
-// jwtSecretString will be set at build time via -ldflags -X
-var jwtSecretString = "default-secret-change-me"
+// Secret used when none is configured, only accepted with -insecure-jwt-secret
+const defaultJWTSecret = "default-secret-change-me"
 
-// Convert string to byte slice for use with JWT library
-var jwtSecret = []byte(jwtSecretString)
+// jwtSecretString will be set at build time via -ldflags -X, and is used
+// when no key is configured at runtime, see loadKeyring
+var jwtSecretString = defaultJWTSecret
+
+// Scope of restricted tokens that only allow setting a new password
+const scopePasswordChange = "password_change"
+
+// Scope of challenge tokens that only allow completing a login with a second factor
+const scopeMFARequired = "mfa_required"
+
+// Scope of tokens that only allow enrolling a second factor required by policy
+const scopeMFAEnrollment = "mfa_enrollment"
+
+// Lifetime of restricted tokens
+const restrictedTokenTTL = 15 * time.Minute
+
+// Errors returned to clients holding a restricted token on other routes
+var scopeErrors = map[string]string{
+	scopePasswordChange: "Password change required",
+	scopeMFARequired:    "Two-factor authentication required",
+	scopeMFAEnrollment:  "Two-factor authentication enrollment required",
+}
 
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	Scope     string `json:"scope,omitempty"` // Restricts the token to routes accepting this scope
+	SessionID string `json:"sid,omitempty"`   // Session the token was issued for, see Session
 	jwt.RegisteredClaims
 }
 
-// Generate JWT access token
-func generateAccessToken(user *User) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour) // 24 hours
+// Generate JWT access token for a session, see accessTokenExpiry
+func generateAccessToken(user *User, sessionID string, expiresAt time.Time) (string, error) {
+	return generateScopedToken(user, "", sessionID, time.Until(expiresAt))
+}
+
+// Generate a short-lived token that is only accepted by routes allowing the scope
+func generateRestrictedToken(user *User, scope string) (string, error) {
+	return generateScopedToken(user, scope, "", restrictedTokenTTL)
+}
+
+func generateScopedToken(user *User, scope string, sessionID string, ttl time.Duration) (string, error) {
+	// Token ID so single tokens can be revoked
+	id, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	expirationTime := time.Now().Add(ttl)
 	claims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Role:     user.Role,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		Scope:     scope,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Issuer:    settings.JWTIssuer,
+			Audience:  jwt.ClaimStrings{settings.JWTAudience},
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return keyring.Sign(claims)
 }
 
 // Generate refresh token
-func generateRefreshToken() string {
+func generateRefreshToken(expiresAt time.Time) string {
+	// Random ID so tokens issued within the same second never collide
+	id, err := generateOpaqueToken()
+	if err != nil {
+		return ""
+	}
+
 	// Generate a simple refresh token using JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(7 * 24 * time.Hour)), // 7 days
+	tokenString, err := keyring.Sign(jwt.RegisteredClaims{
+		ID:        id,
+		Issuer:    settings.JWTIssuer,
+		Audience:  jwt.ClaimStrings{settings.JWTAudience},
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
 		IssuedAt:  jwt.NewNumericDate(time.Now()),
 	})
-
-	tokenString, err := token.SignedString(jwtSecret)
 	if err != nil {
 		return ""
 	}
 	return tokenString
 }
 
+// Generate a random URL-safe token for links sent to users
+func generateOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash a token before storing it, so a database leak does not expose usable tokens
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returned when an already rotated refresh token is presented again
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// Log security relevant events, such as detected token theft, to the audit trail
+func logSecurityEvent(event string, userID int, details string) {
+	recordAuditEvent(event, userID, "", details)
+}
+
+// Log a security relevant event caused by a request, together with the client IP
+func logRequestSecurityEvent(c *fiber.Ctx, event string, userID int, details string) {
+	recordAuditEvent(event, userID, c.IP(), details)
+}
+
 // Validate JWT token
 func validateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, claims, keyring.Keyfunc,
+		jwt.WithIssuer(settings.JWTIssuer),
+		jwt.WithAudience(settings.JWTAudience),
+	)
 
 	if err != nil {
 		return nil, err
@@ -71,8 +155,19 @@ func validateToken(tokenString string) (*Claims, error) {
 	return claims, nil
 }
 
-// Auth middleware to validate JWT tokens
+// Auth middleware to validate JWT tokens, rejecting restricted tokens
 func authMiddleware(c *fiber.Ctx) error {
+	return authenticate(c, nil)
+}
+
+// Auth middleware that also accepts restricted tokens of the given scopes
+func scopedAuthMiddleware(scopes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return authenticate(c, scopes)
+	}
+}
+
+func authenticate(c *fiber.Ctx, scopes []string) error {
 	authHeader := c.Get("Authorization")
 	if authHeader == "" {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -81,14 +176,13 @@ func authMiddleware(c *fiber.Ctx) error {
 	}
 
 	// Extract token from "Bearer <token>"
-	parts := strings.Split(authHeader, " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
+	token, ok := bearerToken(authHeader)
+	if !ok {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid authorization header format",
 		})
 	}
 
-	token := parts[1]
 	claims, err := validateToken(token)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
@@ -96,14 +190,90 @@ func authMiddleware(c *fiber.Ctx) error {
 		})
 	}
 
+	// Revoked tokens stop working immediately
+	revoked, err := isTokenRevoked(claims)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if revoked {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Token has been revoked",
+		})
+	}
+
+	// Tokens of revoked sessions stop working immediately
+	if claims.SessionID != "" {
+		active, err := touchSession(claims.SessionID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Internal server error",
+			})
+		}
+		if !active {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Session has been revoked",
+			})
+		}
+	}
+
+	// Restricted tokens only work on routes accepting their scope
+	if claims.Scope != "" && !slices.Contains(scopes, claims.Scope) {
+		message, ok := scopeErrors[claims.Scope]
+		if !ok {
+			message = "Token is not valid for this endpoint"
+		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	// Disabled users and changed roles take effect before the token expires
+	if settings.StrictAuth {
+		user, err := getCachedUser(claims.UserID)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "User not found",
+				})
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Internal server error",
+			})
+		}
+		if user.Status != "active" {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User is disabled",
+			})
+		}
+		if user.Role != claims.Role {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "User role has changed",
+			})
+		}
+	}
+
 	// Store user info in context
 	c.Locals("userID", claims.UserID)
 	c.Locals("username", claims.Username)
 	c.Locals("role", claims.Role)
+	c.Locals("scope", claims.Scope)
+	c.Locals("sessionID", claims.SessionID)
+	c.Locals("claims", claims)
 
 	return c.Next()
 }
 
+// Extract the token from a "Bearer <token>" authorization header
+func bearerToken(authHeader string) (string, bool) {
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
+
 // Admin middleware to ensure user has admin role
 func adminMiddleware(c *fiber.Ctx) error {
 	role := c.Locals("role")
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+)
+
+// Length of a hex encoded SHA-1 hash
+const sha1HexLength = 40
+
+// Sorted list of SHA-1 hashes of breached passwords, one upper case hash per
+// line, optionally followed by ":count" as in the Pwned Passwords downloads.
+// The file is memory-mapped where supported, so it is not read into memory.
+type BreachedPasswordList struct {
+	data []byte
+}
+
+// Breached password list, nil when no list is configured
+var breachedPasswords *BreachedPasswordList
+
+// Open a breached password list from a file sorted by hash
+func openBreachedPasswordList(path string) (*BreachedPasswordList, error) {
+	data, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < sha1HexLength {
+		return nil, fmt.Errorf("breached password list %s is empty", path)
+	}
+	first := data[:sha1HexLength]
+	if _, err := hex.DecodeString(string(first)); err != nil || !bytes.Equal(first, bytes.ToUpper(first)) {
+		return nil, fmt.Errorf("breached password list %s does not start with an upper case SHA-1 hash", path)
+	}
+	return &BreachedPasswordList{data: data}, nil
+}
+
+// Contains checks whether a password is in the list, with a binary search
+// over the lines of the file
+func (l *BreachedPasswordList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	target := []byte(fmt.Sprintf("%X", sum))
+
+	// lo and hi are always at the start of a line
+	lo, hi := 0, len(l.data)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		start := bytes.LastIndexByte(l.data[lo:mid], '\n') + 1 + lo
+		end := bytes.IndexByte(l.data[start:hi], '\n')
+		if end < 0 {
+			end = hi
+		} else {
+			end += start
+		}
+
+		line := l.data[start:end]
+		if len(line) > sha1HexLength {
+			line = line[:sha1HexLength]
+		}
+		switch bytes.Compare(line, target) {
+		case 0:
+			return true
+		case -1:
+			lo = end + 1
+		default:
+			hi = start
+		}
+	}
+	return false
+}
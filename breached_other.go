@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Read a file into memory, on systems without mmap support
+func mapFile(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Write a breached password list of the given passwords, sorted by hash, with
+// each line formatted by line
+func writeBreachedPasswordList(t *testing.T, passwords []string, line func(hash string) string) string {
+	t.Helper()
+	hashes := make([]string, len(passwords))
+	for i, password := range passwords {
+		hashes[i] = fmt.Sprintf("%X", sha1.Sum([]byte(password)))
+	}
+	sort.Strings(hashes)
+
+	var content strings.Builder
+	for _, hash := range hashes {
+		content.WriteString(line(hash))
+	}
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(content.String()), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBreachedPasswordListContains(t *testing.T) {
+	// Sorted by hash: football, password, 123456, sunshine, dragon, letmein, iloveyou
+	listed := []string{"password", "123456", "sunshine", "dragon", "letmein", "iloveyou", "football"}
+
+	formats := []struct {
+		name string
+		line func(hash string) string
+	}{
+		{"hashes", func(hash string) string { return hash + "\n" }},
+		{"counts", func(hash string) string { return hash + ":42\n" }},
+		{"crlf", func(hash string) string { return hash + "\r\n" }},
+		{"counts with crlf", func(hash string) string { return hash + ":7\r\n" }},
+	}
+	tests := []struct {
+		name     string
+		password string
+		want     bool
+	}{
+		{"first line", "football", true},
+		{"last line", "iloveyou", true},
+		{"middle line", "sunshine", true},
+		{"missing between password and 123456", "Password1", false},
+		{"missing between sunshine and dragon", "monkey", false},
+		{"missing after the last line", "qwerty", false},
+		{"different case of a listed password", "PASSWORD", false},
+		{"lower case password", "password", true},
+		{"empty password", "", false},
+	}
+
+	for _, format := range formats {
+		list, err := openBreachedPasswordList(writeBreachedPasswordList(t, listed, format.line))
+		if err != nil {
+			t.Fatalf("%s: %v", format.name, err)
+		}
+		for _, tt := range tests {
+			t.Run(format.name+"/"+tt.name, func(t *testing.T) {
+				if got := list.Contains(tt.password); got != tt.want {
+					t.Errorf("Contains(%q) = %v, want %v", tt.password, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestOpenBreachedPasswordListRejectsLowerCaseHashes(t *testing.T) {
+	path := writeBreachedPasswordList(t, []string{"password"}, func(hash string) string {
+		return strings.ToLower(hash) + "\n"
+	})
+	if _, err := openBreachedPasswordList(path); err == nil {
+		t.Error("openBreachedPasswordList accepted a list of lower case hashes")
+	}
+}
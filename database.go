@@ -10,23 +10,28 @@ import (
 )
 
 type User struct {
-	ID        int    `json:"id"`
-	Username  string `json:"username"`
-	Email     string `json:"email"`
-	Name      string `json:"name"`
-	Avatar    string `json:"avatar"`
-	Role      string `json:"role"`   // "admin" or "user"
-	Status    string `json:"status"` // "active" or "disabled"
-	Password  string `json:"-"`      // Don't include in JSON responses
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID                 int     `json:"id"`
+	Username           string  `json:"username"`
+	Email              string  `json:"email"`
+	EmailVerifiedAt    *string `json:"email_verified_at"` // nil until the email is verified
+	Name               string  `json:"name"`
+	Avatar             string  `json:"avatar"`
+	Role               string  `json:"role"`                 // "admin" or "user"
+	Status             string  `json:"status"`               // "active", "disabled" or "pending"
+	Password           string  `json:"-"`                    // Don't include in JSON responses
+	MustChangePassword bool    `json:"must_change_password"` // Login only allows changing the password
+	CreatedAt          string  `json:"created_at"`
+	UpdatedAt          string  `json:"updated_at"`
 }
 
 type Token struct {
-	AccessToken  string `json:"access_token"`
-	TokenType    string `json:"token_type"`
-	ExpiresIn    int    `json:"expires_in"`
-	RefreshToken string `json:"refresh_token,omitempty"`
+	AccessToken       string `json:"access_token"`
+	TokenType         string `json:"token_type"`
+	ExpiresIn         int    `json:"expires_in"`
+	RefreshToken      string `json:"refresh_token,omitempty"`
+	Scope             string `json:"scope,omitempty"`               // Set for restricted tokens, see Claims.Scope
+	MFAEnrollBy       string `json:"mfa_enroll_by,omitempty"`       // Deadline to enable two-factor authentication, if required
+	PasswordExpiresAt string `json:"password_expires_at,omitempty"` // Time the password has to be changed by, if passwords expire
 }
 
 // Database connection
@@ -51,6 +56,8 @@ func initDatabase(sqlitePath string) error {
 		role TEXT NOT NULL DEFAULT 'user',
 		status TEXT NOT NULL DEFAULT 'active',
 		password TEXT NOT NULL,
+		email_verified_at DATETIME,
+		must_change_password INTEGER NOT NULL DEFAULT 0,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 	);`
@@ -60,29 +67,287 @@ func initDatabase(sqlitePath string) error {
 	CREATE TABLE IF NOT EXISTS refresh_tokens (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		user_id INTEGER NOT NULL,
-		token TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		family_id TEXT,
 		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
 		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		FOREIGN KEY (user_id) REFERENCES users (id)
 	);`
 
+	// Create menus table, one row per menu item
+	createMenusTable := `
+	CREATE TABLE IF NOT EXISTS menus (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		role TEXT NOT NULL,
+		parent_id INTEGER,
+		position INTEGER NOT NULL DEFAULT 0,
+		route TEXT NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL DEFAULT 'link',
+		icon TEXT DEFAULT '',
+		label_color TEXT DEFAULT '',
+		label_value TEXT DEFAULT '',
+		badge_color TEXT DEFAULT '',
+		badge_value TEXT DEFAULT '',
+		hidden INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (parent_id) REFERENCES menus (id)
+	);`
+
+	// Create email_verification_tokens table
+	createEmailVerificationTokensTable := `
+	CREATE TABLE IF NOT EXISTS email_verification_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		email TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create password_reset_tokens table
+	createPasswordResetTokensTable := `
+	CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create sessions table
+	createSessionsTable := `
+	CREATE TABLE IF NOT EXISTS sessions (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		user_agent TEXT DEFAULT '',
+		ip TEXT DEFAULT '',
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create table of generated key pairs JWTs are signed with
+	createSigningKeysTable := `
+	CREATE TABLE IF NOT EXISTS signing_keys (
+		id TEXT PRIMARY KEY,
+		algorithm TEXT NOT NULL,
+		private_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME
+	);`
+
+	// Create table of secrets retired by switching to key pairs, by key ID
+	createRetiredSecretsTable := `
+	CREATE TABLE IF NOT EXISTS retired_secrets (
+		id TEXT PRIMARY KEY,
+		expires_at DATETIME NOT NULL
+	);`
+
+	// Create table of TOTP second factors, confirmed once the user entered a code
+	createUserTOTPTable := `
+	CREATE TABLE IF NOT EXISTS user_totp (
+		user_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		confirmed_at DATETIME,
+		last_used_step INTEGER NOT NULL DEFAULT 0,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create table of single use recovery codes for the second factor
+	createRecoveryCodesTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		code_hash TEXT NOT NULL,
+		used_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create table of WebAuthn credentials (passkeys), stored as serialized by the library
+	createWebAuthnCredentialsTable := `
+	CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		credential_id TEXT UNIQUE NOT NULL,
+		name TEXT NOT NULL,
+		credential TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		last_used_at DATETIME,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create denylist of revoked access tokens, kept until the tokens expire
+	createRevokedTokensTable := `
+	CREATE TABLE IF NOT EXISTS revoked_tokens (
+		jti TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at DATETIME NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	// Create table of replaced password hashes, so recent passwords are not reused
+	createPasswordHistoryTable := `
+	CREATE TABLE IF NOT EXISTS password_history (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users (id)
+	);`
+
+	// Create table of failed logins by hashed username, kept for unknown usernames too
+	createLoginFailuresTable := `
+	CREATE TABLE IF NOT EXISTS login_failures (
+		username_hash TEXT PRIMARY KEY,
+		failed_attempts INTEGER NOT NULL DEFAULT 0,
+		last_failed_at DATETIME NOT NULL,
+		locked_until DATETIME
+	);`
+
+	// Create audit trail of security events
+	createAuditEventsTable := `
+	CREATE TABLE IF NOT EXISTS audit_events (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event TEXT NOT NULL,
+		user_id INTEGER,
+		ip TEXT NOT NULL DEFAULT '',
+		details TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);`
+
 	if _, err := db.Exec(createUsersTable); err != nil {
 		return err
 	}
 
+	// Refresh tokens used to be stored in plaintext, drop them so only hashes remain.
+	// Users that chose remember me have to log in again.
+	var plaintextTokens int
+	err = db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('refresh_tokens') WHERE name = 'token'").Scan(&plaintextTokens)
+	if err != nil {
+		return err
+	}
+	if plaintextTokens > 0 {
+		if _, err := db.Exec("DROP TABLE refresh_tokens"); err != nil {
+			return err
+		}
+	}
+
 	if _, err := db.Exec(createTokensTable); err != nil {
 		return err
 	}
 
+	if _, err := db.Exec(createRevokedTokensTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createSigningKeysTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createRetiredSecretsTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createUserTOTPTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createRecoveryCodesTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createWebAuthnCredentialsTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createMenusTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createEmailVerificationTokensTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createPasswordResetTokensTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createSessionsTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createAuditEventsTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createPasswordHistoryTable); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createLoginFailuresTable); err != nil {
+		return err
+	}
+
 	// Add migration for existing databases to add role and status columns
 	addRoleColumn := `ALTER TABLE users ADD COLUMN role TEXT DEFAULT 'user';`
 	addStatusColumn := `ALTER TABLE users ADD COLUMN status TEXT DEFAULT 'active';`
 	addUpdatedAtColumn := `ALTER TABLE users ADD COLUMN updated_at DATETIME DEFAULT CURRENT_TIMESTAMP;`
+	addEmailVerifiedAtColumn := `ALTER TABLE users ADD COLUMN email_verified_at DATETIME;`
+	addMustChangePasswordColumn := `ALTER TABLE users ADD COLUMN must_change_password INTEGER NOT NULL DEFAULT 0;`
+	addTokensValidAfterColumn := `ALTER TABLE users ADD COLUMN tokens_valid_after INTEGER NOT NULL DEFAULT 0;`
+	addMFAGraceUntilColumn := `ALTER TABLE users ADD COLUMN mfa_grace_until DATETIME;`
+	addPasswordChangedAtColumn := `ALTER TABLE users ADD COLUMN password_changed_at DATETIME;`
 
 	// These will fail if columns already exist, which is fine
 	db.Exec(addRoleColumn)
 	db.Exec(addStatusColumn)
 	db.Exec(addUpdatedAtColumn)
+	db.Exec(addEmailVerifiedAtColumn)
+	db.Exec(addMustChangePasswordColumn)
+	db.Exec(addTokensValidAfterColumn)
+	db.Exec(addMFAGraceUntilColumn)
+	db.Exec(addPasswordChangedAtColumn)
+
+	// Add migration for existing databases to track refresh token rotation,
+	// every existing token becomes its own family
+	addFamilyIDColumn := `ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT;`
+	addUsedAtColumn := `ALTER TABLE refresh_tokens ADD COLUMN used_at DATETIME;`
+	db.Exec(addFamilyIDColumn)
+	db.Exec(addUsedAtColumn)
+	db.Exec(`UPDATE refresh_tokens SET family_id = 'legacy-' || id WHERE family_id IS NULL;`)
+
+	// Add migration for existing databases to add hidden column to menus
+	addHiddenColumn := `ALTER TABLE menus ADD COLUMN hidden INTEGER NOT NULL DEFAULT 0;`
+	db.Exec(addHiddenColumn)
+
+	// Add migration for existing databases to limit the lifetime of sessions
+	addMaxExpiresAtColumn := `ALTER TABLE sessions ADD COLUMN max_expires_at DATETIME;`
+	db.Exec(addMaxExpiresAtColumn)
+
+	// Add migration for existing databases to retire signing keys
+	addSigningKeyExpiresAtColumn := `ALTER TABLE signing_keys ADD COLUMN expires_at DATETIME;`
+	db.Exec(addSigningKeyExpiresAtColumn)
+
+	// Refresh tokens issued before sessions were tracked have no session, which
+	// their access tokens need. Create one for each family still in use.
+	_, err = db.Exec(`
+		INSERT OR IGNORE INTO sessions (id, user_id, expires_at)
+		SELECT family_id, user_id, MAX(expires_at) FROM refresh_tokens
+		WHERE used_at IS NULL AND expires_at > ?
+		GROUP BY family_id, user_id`, time.Now())
+	if err != nil {
+		return err
+	}
 
 	// Create default admin user if not exists
 	if err = createDefaultAdminUser(); err != nil {
@@ -92,6 +357,19 @@ func initDatabase(sqlitePath string) error {
 	if err = createDefaultUser(); err != nil {
 		return err
 	}
+	// Seed default menus if not exists
+	if err = createDefaultMenus(); err != nil {
+		return err
+	}
+	// Passwords without a known age, from before tracking it, are considered set now
+	_, err = db.Exec("UPDATE users SET password_changed_at = ? WHERE password_changed_at IS NULL", time.Now())
+	if err != nil {
+		return err
+	}
+	// Users get their two-factor enrollment grace period once the policy applies to them
+	if err = updateMFAGracePeriods(); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -146,11 +424,11 @@ func createDefaultUser() error {
 func getUserByUsername(username string) (*User, error) {
 	user := &User{}
 	err := db.QueryRow(`
-		SELECT id, username, email, name, avatar, role, status, password, 
-		       created_at, updated_at
+		SELECT id, username, email, email_verified_at, name, avatar, role, status, password, 
+		       must_change_password, created_at, updated_at
 		FROM users WHERE username = ? AND status = 'active'`, username).Scan(
-		&user.ID, &user.Username, &user.Email, &user.Name, &user.Avatar,
-		&user.Role, &user.Status, &user.Password, &user.CreatedAt, &user.UpdatedAt)
+		&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.Name, &user.Avatar,
+		&user.Role, &user.Status, &user.Password, &user.MustChangePassword, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -160,11 +438,25 @@ func getUserByUsername(username string) (*User, error) {
 func getUserByID(id int) (*User, error) {
 	user := &User{}
 	err := db.QueryRow(`
-		SELECT id, username, email, name, avatar, role, status, 
-		       created_at, updated_at
+		SELECT id, username, email, email_verified_at, name, avatar, role, status, 
+		       must_change_password, created_at, updated_at
 		FROM users WHERE id = ?`, id).Scan(
-		&user.ID, &user.Username, &user.Email, &user.Name, &user.Avatar,
-		&user.Role, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+		&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.Name, &user.Avatar,
+		&user.Role, &user.Status, &user.MustChangePassword, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func getUserByEmail(email string) (*User, error) {
+	user := &User{}
+	err := db.QueryRow(`
+		SELECT id, username, email, email_verified_at, name, avatar, role, status, 
+		       must_change_password, created_at, updated_at
+		FROM users WHERE email = ?`, email).Scan(
+		&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.Name, &user.Avatar,
+		&user.Role, &user.Status, &user.MustChangePassword, &user.CreatedAt, &user.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -183,8 +475,8 @@ func getAllUsers(limit, offset int) ([]User, int, error) {
 
 	// Get users with pagination
 	rows, err := db.Query(`
-		SELECT id, username, email, name, avatar, role, status, 
-		       created_at, updated_at
+		SELECT id, username, email, email_verified_at, name, avatar, role, status, 
+		       must_change_password, created_at, updated_at
 		FROM users 
 		ORDER BY created_at DESC 
 		LIMIT ? OFFSET ?`, limit, offset)
@@ -195,8 +487,8 @@ func getAllUsers(limit, offset int) ([]User, int, error) {
 
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Name,
-			&user.Avatar, &user.Role, &user.Status, &user.CreatedAt, &user.UpdatedAt)
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.Name,
+			&user.Avatar, &user.Role, &user.Status, &user.MustChangePassword, &user.CreatedAt, &user.UpdatedAt)
 		if err != nil {
 			return nil, 0, err
 		}
@@ -206,7 +498,7 @@ func getAllUsers(limit, offset int) ([]User, int, error) {
 	return users, total, nil
 }
 
-func createUser(req CreateUserRequest) (*User, error) {
+func createUser(req CreateUserRequest, status string) (*User, error) {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
 		return nil, err
@@ -221,9 +513,9 @@ func createUser(req CreateUserRequest) (*User, error) {
 	}
 
 	result, err := db.Exec(`
-		INSERT INTO users (username, email, name, avatar, role, status, password) 
-		VALUES (?, ?, ?, ?, ?, 'active', ?)`,
-		req.Username, req.Email, req.Name, req.Avatar, req.Role, string(hashedPassword))
+		INSERT INTO users (username, email, name, avatar, role, status, password, password_changed_at) 
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		req.Username, req.Email, req.Name, req.Avatar, req.Role, status, string(hashedPassword), time.Now())
 	if err != nil {
 		return nil, err
 	}
@@ -232,6 +524,9 @@ func createUser(req CreateUserRequest) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := updateMFAGracePeriod(int(id), req.Role); err != nil {
+		return nil, err
+	}
 
 	return getUserByID(int(id))
 }
@@ -242,8 +537,10 @@ func updateUser(id int, req UpdateUserRequest) (*User, error) {
 	args := []interface{}{}
 
 	if req.Email != "" {
+		// A changed email address has to be verified again
+		setParts = append(setParts, "email_verified_at = CASE WHEN email = ? THEN email_verified_at END")
 		setParts = append(setParts, "email = ?")
-		args = append(args, req.Email)
+		args = append(args, req.Email, req.Email)
 	}
 	if req.Name != "" {
 		setParts = append(setParts, "name = ?")
@@ -274,43 +571,255 @@ func updateUser(id int, req UpdateUserRequest) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	invalidateCachedUser(id)
+	if req.Role != "" {
+		if err := updateMFAGracePeriod(id, req.Role); err != nil {
+			return nil, err
+		}
+	}
 
 	return getUserByID(id)
 }
 
 func deleteUser(id int) error {
 	_, err := db.Exec("DELETE FROM users WHERE id = ?", id)
-	return err
+	if err != nil {
+		return err
+	}
+	invalidateCachedUser(id)
+	_, err = db.Exec("DELETE FROM email_verification_tokens WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM password_reset_tokens WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	if err := disableTOTP(id); err != nil {
+		return err
+	}
+	if err := deleteUserPasskeys(id); err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM password_history WHERE user_id = ?", id)
+	if err != nil {
+		return err
+	}
+	return revokeUserSessions(id)
+}
+
+// Check a password against the stored hash of a user
+func verifyUserPassword(id int, password string) error {
+	var hashedPassword string
+	err := db.QueryRow("SELECT password FROM users WHERE id = ?", id).Scan(&hashedPassword)
+	if err != nil {
+		return err
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+}
+
+// Set a password chosen by the user, which clears any pending forced change
+func setUserPassword(id int, password string) error {
+	return storeUserPassword(id, password, false)
+}
+
+// Set a temporary password that has to be changed on next login
+func setTemporaryPassword(id int, password string) error {
+	return storeUserPassword(id, password, true)
+}
+
+// Replace the password of a user, keeping the hash of the old one in the
+// password history
+func storeUserPassword(id int, password string, mustChange bool) error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writeUserPassword(tx, id, hashedPassword, mustChange); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Replace the password hash of a user within a transaction, see storeUserPassword
+func writeUserPassword(tx *sql.Tx, id int, hashedPassword []byte, mustChange bool) error {
+	if settings.PasswordHistory > 1 {
+		_, err := tx.Exec(`
+			INSERT INTO password_history (user_id, password_hash)
+			SELECT id, password FROM users WHERE id = ?`, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The current password counts towards the history, older ones are dropped
+	_, err := tx.Exec(`
+		DELETE FROM password_history
+		WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?
+		)`, id, id, max(settings.PasswordHistory-1, 0))
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+		UPDATE users SET password = ?, must_change_password = ?, password_changed_at = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`, string(hashedPassword), mustChange, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Check whether a password matches the current password of a user or one of
+// the previous ones kept in the password history
+func isPasswordReused(id int, password string) (bool, error) {
+	rows, err := db.Query(`
+		SELECT password FROM users WHERE id = ?
+		UNION ALL
+		SELECT password_hash FROM (
+			SELECT password_hash FROM password_history WHERE user_id = ? ORDER BY id DESC LIMIT ?
+		)`, id, id, max(settings.PasswordHistory-1, 0))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hashedPassword string
+		if err := rows.Scan(&hashedPassword); err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) == nil {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
 }
 
-func saveRefreshToken(userID int, token string, expiresAt time.Time) error {
+// Time the password of a user expires, zero if passwords do not expire
+func passwordExpiry(id int) (time.Time, error) {
+	if settings.PasswordMaxAge == 0 {
+		return time.Time{}, nil
+	}
+	var changedAt time.Time
+	err := db.QueryRow("SELECT password_changed_at FROM users WHERE id = ?", id).Scan(&changedAt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return changedAt.Add(settings.PasswordMaxAge), nil
+}
+
+func saveRefreshToken(userID int, token string, familyID string, expiresAt time.Time) error {
 	_, err := db.Exec(`
-		INSERT INTO refresh_tokens (user_id, token, expires_at) 
-		VALUES (?, ?, ?)`, userID, token, expiresAt)
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at) 
+		VALUES (?, ?, ?, ?)`, userID, hashToken(token), familyID, expiresAt)
 	return err
 }
 
-func validateRefreshToken(token string) (int, error) {
-	var userID int
-	var expiresAt time.Time
-	err := db.QueryRow(`
-		SELECT user_id, expires_at 
+// Exchange a refresh token for a new one of the same family and return the
+// user, family (session) ID and expiry of the new token, which never passes
+// the deadline of the session. A token can only be used once: presenting an
+// already rotated token means it was copied, so the whole family and its
+// session are revoked and errRefreshTokenReused returned.
+func rotateRefreshToken(token string, newToken string, expiresAt time.Time) (int, string, time.Time, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	defer tx.Rollback()
+
+	var id, userID int
+	var familyID string
+	var tokenExpiresAt time.Time
+	var usedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, user_id, family_id, expires_at, used_at
 		FROM refresh_tokens 
-		WHERE token = ?`, token).Scan(&userID, &expiresAt)
+		WHERE token_hash = ?`, hashToken(token)).Scan(&id, &userID, &familyID, &tokenExpiresAt, &usedAt)
 	if err != nil {
-		return 0, err
+		return 0, "", time.Time{}, err
+	}
+
+	// A reused token means it was stolen, revoke the whole family
+	revokeFamily := func() (int, string, time.Time, error) {
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", familyID); err != nil {
+			return 0, "", time.Time{}, err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE id = ?", familyID); err != nil {
+			return 0, "", time.Time{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", time.Time{}, err
+		}
+		logSecurityEvent("refresh_token_reuse", userID, "revoked refresh token family "+familyID)
+		return userID, "", time.Time{}, errRefreshTokenReused
+	}
+
+	if usedAt.Valid {
+		return revokeFamily()
 	}
 
-	if time.Now().After(expiresAt) {
+	if time.Now().After(tokenExpiresAt) {
 		// Token expired, delete it
-		db.Exec("DELETE FROM refresh_tokens WHERE token = ?", token)
-		return 0, sql.ErrNoRows
+		if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE id = ?", id); err != nil {
+			return 0, "", time.Time{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, "", time.Time{}, err
+		}
+		return 0, "", time.Time{}, sql.ErrNoRows
 	}
 
-	return userID, nil
-}
+	// Refreshes cannot extend a session past its deadline
+	var deadline sql.NullTime
+	err = tx.QueryRow("SELECT max_expires_at FROM sessions WHERE id = ?", familyID).Scan(&deadline)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, "", time.Time{}, err
+	}
+	if deadline.Valid {
+		expiresAt = capExpiry(expiresAt, deadline.Time)
+		if !time.Now().Before(expiresAt) {
+			if _, err := tx.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", familyID); err != nil {
+				return 0, "", time.Time{}, err
+			}
+			if _, err := tx.Exec("DELETE FROM sessions WHERE id = ?", familyID); err != nil {
+				return 0, "", time.Time{}, err
+			}
+			if err := tx.Commit(); err != nil {
+				return 0, "", time.Time{}, err
+			}
+			return 0, "", time.Time{}, sql.ErrNoRows
+		}
+	}
 
-func deleteRefreshToken(token string) error {
-	_, err := db.Exec("DELETE FROM refresh_tokens WHERE token = ?", token)
-	return err
+	// Keep the used token around to detect reuse until it expires. Only one of
+	// concurrent refreshes with the same token can mark it used.
+	result, err := tx.Exec("UPDATE refresh_tokens SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", id)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return 0, "", time.Time{}, err
+	} else if rows == 0 {
+		return revokeFamily()
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (user_id, token_hash, family_id, expires_at) 
+		VALUES (?, ?, ?, ?)`, userID, hashToken(newToken), familyID, expiresAt)
+	if err != nil {
+		return 0, "", time.Time{}, err
+	}
+
+	return userID, familyID, expiresAt, tx.Commit()
 }
@@ -49,16 +49,41 @@ type UpdateUserRequest struct {
 	Avatar string `json:"avatar,omitempty"`
 }
 
+// Fields users may change on their own profile
+type UpdateProfileRequest struct {
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
 type UserResponse struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	Email     string `json:"email"`
-	Avatar    string `json:"avatar"`
-	Username  string `json:"username"`
-	Role      string `json:"role"`
-	Status    string `json:"status"`
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	ID                 int     `json:"id"`
+	Name               string  `json:"name"`
+	Email              string  `json:"email"`
+	EmailVerifiedAt    *string `json:"email_verified_at"`
+	Avatar             string  `json:"avatar"`
+	Username           string  `json:"username"`
+	Role               string  `json:"role"`
+	Status             string  `json:"status"`
+	MustChangePassword bool    `json:"must_change_password"`
+	CreatedAt          string  `json:"created_at"`
+	UpdatedAt          string  `json:"updated_at"`
+}
+
+func newUserResponse(user *User) UserResponse {
+	return UserResponse{
+		ID:                 user.ID,
+		Name:               user.Name,
+		Email:              user.Email,
+		EmailVerifiedAt:    user.EmailVerifiedAt,
+		Avatar:             user.Avatar,
+		Username:           user.Username,
+		Role:               user.Role,
+		Status:             user.Status,
+		MustChangePassword: user.MustChangePassword,
+		CreatedAt:          user.CreatedAt,
+		UpdatedAt:          user.UpdatedAt,
+	}
 }
 
 type UsersListResponse struct {
@@ -70,7 +95,7 @@ type UsersListResponse struct {
 // Login godoc
 //
 //	@Summary		User login
-//	@Description	Authenticate user and return tokens
+//	@Description	Authenticate user and return tokens. Users with two-factor authentication get a challenge token with scope "mfa_required" instead, to be completed at /auth/mfa/verify. Users whose role requires two-factor authentication get a token with scope "mfa_enrollment" once their grace period is over. Repeated failures lock the account and throttle the client IP for an exponentially growing time. Users with a temporary or expired password get a token with scope "password_change" that only allows setting a new password.
 //	@Tags			auth
 //	@Accept			json
 //	@Produce		json
@@ -78,6 +103,7 @@ type UsersListResponse struct {
 //	@Success		200				{object}	Token
 //	@Failure		400				{object}	ErrorResponse	"Invalid request body or missing required fields"
 //	@Failure		401				{object}	ErrorResponse	"Invalid credentials"
+//	@Failure		429				{object}	ErrorResponse	"Too many failed login attempts, see the Retry-After header"
 //	@Failure		500				{object}	ErrorResponse	"Internal server error"
 //	@Router			/auth/login [POST]
 func loginHandler(c *fiber.Ctx) error {
@@ -95,10 +121,30 @@ func loginHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	// Slow down password guessing from the same client
+	if retryAfter := ipLoginRetryAfter(c.IP()); retryAfter > 0 {
+		return tooManyLoginAttempts(c, retryAfter)
+	}
+
+	// Locked usernames are refused even with the right password, unknown
+	// ones lock the same way
+	retryAfter, err := usernameLoginRetryAfter(req.Username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if retryAfter > 0 {
+		return tooManyLoginAttempts(c, retryAfter)
+	}
+
 	// Get user from database
 	user, err := getUserByUsername(req.Username)
 	if err != nil {
 		if err == sql.ErrNoRows {
+			if err := recordLoginFailure(c, 0, req.Username); err != nil {
+				log.Warnf("Failed to record failed login: %v", err)
+			}
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid credentials",
 			})
@@ -110,13 +156,111 @@ func loginHandler(c *fiber.Ctx) error {
 
 	// Verify password
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		if err := recordLoginFailure(c, user.ID, req.Username); err != nil {
+			log.Warnf("Failed to record failed login: %v", err)
+		}
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
 	}
 
+	// Users with two-factor authentication have to confirm the login with a code
+	totpEnabled, err := isTOTPEnabled(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if totpEnabled {
+		challengeToken, err := generateRestrictedToken(user, scopeMFARequired)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate access token",
+			})
+		}
+		return c.Status(fiber.StatusOK).JSON(Token{
+			AccessToken: challengeToken,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(restrictedTokenTTL.Seconds()),
+			Scope:       scopeMFARequired,
+		})
+	}
+
+	return completeLogin(c, user, req.RememberMe, false)
+}
+
+// Issue the tokens of an authenticated login. Logins that passed a second
+// factor, or a passkey, are not subject to the two-factor enrollment policy.
+func completeLogin(c *fiber.Ctx, user *User, rememberMe bool, mfaSatisfied bool) error {
+	// Failed logins only count until a login fully succeeds, second factor included
+	if err := resetUsernameLoginFailures(user.Username); err != nil {
+		log.Warnf("Failed to reset failed logins of user %d: %v", user.ID, err)
+	}
+
+	// Users with a temporary or expired password only get a token to change it
+	passwordExpiresAt, err := passwordExpiry(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	passwordExpired := !passwordExpiresAt.IsZero() && time.Now().After(passwordExpiresAt)
+	if user.MustChangePassword || passwordExpired {
+		restrictedToken, err := generateRestrictedToken(user, scopePasswordChange)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate access token",
+			})
+		}
+		return c.Status(fiber.StatusOK).JSON(Token{
+			AccessToken: restrictedToken,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(restrictedTokenTTL.Seconds()),
+			Scope:       scopePasswordChange,
+		})
+	}
+
+	// Users that must have two-factor authentication only get a token to
+	// enroll once their grace period is over
+	var enrollBy time.Time
+	if !mfaSatisfied {
+		if enrollBy, err = mfaEnrollmentDeadline(user); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Internal server error",
+			})
+		}
+	}
+	if !enrollBy.IsZero() && time.Now().After(enrollBy) {
+		restrictedToken, err := generateRestrictedToken(user, scopeMFAEnrollment)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate access token",
+			})
+		}
+		return c.Status(fiber.StatusOK).JSON(Token{
+			AccessToken: restrictedToken,
+			TokenType:   "Bearer",
+			ExpiresIn:   int(restrictedTokenTTL.Seconds()),
+			Scope:       scopeMFAEnrollment,
+		})
+	}
+
+	// Every login is a session, remembered ones can be refreshed
+	deadline := sessionDeadline()
+	sessionExpiresAt := capExpiry(time.Now().Add(settings.AccessTokenTTL), deadline)
+	if rememberMe {
+		sessionExpiresAt = capExpiry(time.Now().Add(settings.RememberMeTTL), deadline)
+	}
+	sessionID, err := createSession(c, user.ID, sessionExpiresAt, deadline)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create session",
+		})
+	}
+
 	// Generate tokens
-	accessToken, err := generateAccessToken(user)
+	accessExpiresAt := accessTokenExpiry(sessionExpiresAt)
+	accessToken, err := generateAccessToken(user, sessionID, accessExpiresAt)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate access token",
@@ -126,15 +270,22 @@ func loginHandler(c *fiber.Ctx) error {
 	response := Token{
 		AccessToken: accessToken,
 		TokenType:   "Bearer",
-		ExpiresIn:   86400, // 24 hours in seconds
+		ExpiresIn:   expiresIn(accessExpiresAt),
+	}
+	if !enrollBy.IsZero() {
+		response.MFAEnrollBy = enrollBy.UTC().Format(time.RFC3339)
+	}
+	if !passwordExpiresAt.IsZero() {
+		response.PasswordExpiresAt = passwordExpiresAt.UTC().Format(time.RFC3339)
 	}
 
-	// Generate refresh token if remember me is true
-	if req.RememberMe {
-		refreshToken := generateRefreshToken()
-		expiresAt := time.Now().Add(7 * 24 * time.Hour) // 7 days
-		if err := saveRefreshToken(user.ID, refreshToken, expiresAt); err == nil {
-			response.RefreshToken = refreshToken
+	// Generate refresh token if remember me is true, the session ID is its family
+	if rememberMe {
+		refreshToken := generateRefreshToken(sessionExpiresAt)
+		if refreshToken != "" {
+			if err := saveRefreshToken(user.ID, refreshToken, sessionID, sessionExpiresAt); err == nil {
+				response.RefreshToken = refreshToken
+			}
 		}
 	}
 
@@ -145,7 +296,7 @@ func loginHandler(c *fiber.Ctx) error {
 // Refresh access token godoc
 //
 //	@Summary		Refresh access token
-//	@Description	Generate a new access token using a refresh token
+//	@Description	Generate a new access token and a new refresh token using a refresh token. Refresh tokens are single use; reusing one revokes all tokens rotated from the same login.
 //	@Tags			auth
 //	@Accept			json
 //	@Produce		json
@@ -169,13 +320,23 @@ func refreshHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	// Validate refresh token
-	userID, err := validateRefreshToken(req.RefreshToken)
+	// Exchange the refresh token for a new one, each token works only once
+	expiresAt := time.Now().Add(settings.RefreshTokenTTL)
+	newRefreshToken := generateRefreshToken(expiresAt)
+	if newRefreshToken == "" {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate refresh token",
+		})
+	}
+	userID, sessionID, expiresAt, err := rotateRefreshToken(req.RefreshToken, newRefreshToken, expiresAt)
 	if err != nil {
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid or expired refresh token",
 		})
 	}
+	if err := extendSession(sessionID, expiresAt); err != nil {
+		log.Warnf("Failed to extend session of user %d: %v", userID, err)
+	}
 
 	// Get user
 	user, err := getUserByID(userID)
@@ -184,9 +345,41 @@ func refreshHandler(c *fiber.Ctx) error {
 			"error": "User not found",
 		})
 	}
+	if user.Status != "active" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User is disabled",
+		})
+	}
+
+	// Sessions cannot be kept alive past the two-factor enrollment deadline
+	enrollBy, err := mfaEnrollmentDeadline(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if !enrollBy.IsZero() && time.Now().After(enrollBy) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Two-factor authentication enrollment required",
+		})
+	}
+
+	// Nor past the expiry of the password
+	passwordExpiresAt, err := passwordExpiry(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if !passwordExpiresAt.IsZero() && time.Now().After(passwordExpiresAt) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Password expired",
+		})
+	}
 
 	// Generate new access token
-	accessToken, err := generateAccessToken(user)
+	accessExpiresAt := accessTokenExpiry(expiresAt)
+	accessToken, err := generateAccessToken(user, sessionID, accessExpiresAt)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate access token",
@@ -194,9 +387,10 @@ func refreshHandler(c *fiber.Ctx) error {
 	}
 
 	return c.Status(fiber.StatusOK).JSON(Token{
-		AccessToken: accessToken,
-		TokenType:   "Bearer",
-		ExpiresIn:   86400, // 24 hours in seconds
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    expiresIn(accessExpiresAt),
+		RefreshToken: newRefreshToken,
 	})
 }
 
@@ -204,7 +398,7 @@ func refreshHandler(c *fiber.Ctx) error {
 // Logout godoc
 //
 //	@Summary		User logout
-//	@Description	Log out user and invalidate refresh token
+//	@Description	Log out user and revoke the session of the access token in the Authorization header and of the refresh token, if given
 //	@Tags			auth
 //	@Accept			json
 //	@Produce		json
@@ -217,9 +411,19 @@ func logoutHandler(c *fiber.Ctx) error {
 	var req LogoutRequest
 	c.BodyParser(&req)
 
-	// If refresh token is provided, delete it from database
+	// If refresh token is provided, revoke its session
 	if req.RefreshToken != "" {
-		deleteRefreshToken(req.RefreshToken)
+		revokeSessionByRefreshToken(req.RefreshToken)
+	}
+
+	// If a valid access token is provided, revoke it and its session
+	if token, ok := bearerToken(c.Get("Authorization")); ok {
+		if claims, err := validateToken(token); err == nil {
+			revokeAccessToken(claims)
+			if claims.SessionID != "" {
+				revokeSession(claims.UserID, claims.SessionID)
+			}
+		}
 	}
 
 	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
@@ -254,17 +458,75 @@ func userHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(UserResponse{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Username:  user.Username,
-		Role:      user.Role,
-		Status:    user.Status,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
+	return c.Status(fiber.StatusOK).JSON(newUserResponse(user))
+}
+
+// PATCH /user
+// Update profile of the current user
+// @Summary		Update own profile
+// @Description	Update name, email or avatar of the current user. A changed email has to be verified again.
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			updateProfileRequest	body		UpdateProfileRequest	true	"Updated profile fields"
+// @Success		200						{object}	UserResponse
+// @Failure		400						{object}	ErrorResponse	"Invalid request body"
+// @Failure		404						{object}	ErrorResponse	"User not found"
+// @Failure		409						{object}	ErrorResponse	"Email already exists"
+// @Failure		500						{object}	ErrorResponse	"Failed to update user"
+// @Router			/user [PATCH]
+func updateProfileHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req UpdateProfileRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if req.Email != "" && !strings.Contains(req.Email, "@") {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid email address",
+		})
+	}
+
+	previous, err := getUserByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to update user",
+		})
+	}
+
+	// Role and status can only be changed by admins
+	user, err := updateUser(userID, UpdateUserRequest{
+		Email:  req.Email,
+		Name:   req.Name,
+		Avatar: req.Avatar,
 	})
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return c.Status(fiber.StatusConflict).JSON(ErrorResponse{
+				Error: "Email already exists",
+			})
+		}
+		log.Warnf("Failed to update profile of user %d: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to update user",
+		})
+	}
+
+	// A changed email address has to be verified again
+	if user.Email != previous.Email {
+		requestEmailVerification(user)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(newUserResponse(user))
 }
 
 // GET /admin/users
@@ -306,17 +568,7 @@ func getUsersHandler(c *fiber.Ctx) error {
 
 	var userResponses []UserResponse
 	for _, user := range users {
-		userResponses = append(userResponses, UserResponse{
-			ID:        user.ID,
-			Name:      user.Name,
-			Email:     user.Email,
-			Avatar:    user.Avatar,
-			Username:  user.Username,
-			Role:      user.Role,
-			Status:    user.Status,
-			CreatedAt: user.CreatedAt,
-			UpdatedAt: user.UpdatedAt,
-		})
+		userResponses = append(userResponses, newUserResponse(&user))
 	}
 
 	return c.Status(fiber.StatusOK).JSON(UsersListResponse{
@@ -333,8 +585,8 @@ func getUsersHandler(c *fiber.Ctx) error {
 // @Accept			json
 // @Produce		json
 // @Param			createUserRequest	body		CreateUserRequest	true	"User details"
-// @Success		201					{object}	UserResponse
-// @Failure		400					{object}	ErrorResponse	"Invalid request body or missing required fields"
+// @Success		201					{object}	CreatedUserResponse
+// @Failure		400					{object}	PasswordPolicyErrorResponse	"Invalid request body, missing required fields or password violating the policy"
 // @Failure		409					{object}	ErrorResponse	"Username or email already exists"
 // @Failure		500					{object}	ErrorResponse	"Failed to create user"
 // @Router			/admin/users [POST]
@@ -360,7 +612,12 @@ func createUserHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	user, err := createUser(req)
+	if violations := checkPasswordPolicy(req.Password, req.Username, req.Email); len(violations) > 0 {
+		return passwordPolicyError(c, violations)
+	}
+	warnings := checkPasswordWarnings(req.Password)
+
+	user, err := createUser(req, "active")
 	if err != nil {
 		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
 			return c.Status(fiber.StatusConflict).JSON(ErrorResponse{
@@ -372,16 +629,14 @@ func createUserHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(UserResponse{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Username:  user.Username,
-		Role:      user.Role,
-		Status:    user.Status,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
+	logPasswordWarnings(c, user, warnings)
+
+	// Ask the user to confirm their email address
+	requestEmailVerification(user)
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedUserResponse{
+		UserResponse: newUserResponse(user),
+		Warnings:     warnings,
 	})
 }
 
@@ -418,17 +673,7 @@ func getUserByIDHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(UserResponse{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Username:  user.Username,
-		Role:      user.Role,
-		Status:    user.Status,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-	})
+	return c.Status(fiber.StatusOK).JSON(newUserResponse(user))
 }
 
 // PUT /admin/users/:id
@@ -475,6 +720,18 @@ func updateUserHandler(c *fiber.Ctx) error {
 		})
 	}
 
+	previous, err := getUserByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to update user",
+		})
+	}
+
 	user, err := updateUser(id, req)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -492,23 +749,30 @@ func updateUserHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(UserResponse{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Username:  user.Username,
-		Role:      user.Role,
-		Status:    user.Status,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-	})
+	// A changed email address has to be verified again
+	if user.Email != previous.Email {
+		requestEmailVerification(user)
+	}
+
+	// Disabled users are signed out everywhere
+	if user.Status != "active" {
+		if err := revokeUserSessions(user.ID); err != nil {
+			log.Warnf("Failed to revoke sessions of user %d: %v", user.ID, err)
+		}
+	} else if user.Role != previous.Role {
+		// Access tokens carry the role, clients have to refresh them
+		if err := revokeUserTokens(user.ID); err != nil {
+			log.Warnf("Failed to revoke tokens of user %d: %v", user.ID, err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(newUserResponse(user))
 }
 
 // DELETE /admin/users/:id
 // Delete user (admin only)
 // @Summary		Delete user
-// @Description	Delete user by ID (admin only)
+// @Description	Delete user by ID and revoke all of its sessions (admin only)
 // @Tags			admin
 // @Accept			json
 // @Produce		json
@@ -548,7 +812,7 @@ func deleteUserHandler(c *fiber.Ctx) error {
 // PUT /admin/users/:id/enable
 // Enable user (admin only)
 // @Summary		Enable user
-// @Description	Enable a disabled user account (admin only)
+// @Description	Enable a disabled or pending user account (admin only)
 // @Tags			admin
 // @Accept			json
 // @Produce		json
@@ -578,23 +842,13 @@ func enableUserHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(UserResponse{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Username:  user.Username,
-		Role:      user.Role,
-		Status:    user.Status,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-	})
+	return c.JSON(newUserResponse(user))
 }
 
 // PUT /admin/users/:id/disable
 // Disable user (admin only)
 // @Summary		Disable user
-// @Description	Disable a user account (admin only)
+// @Description	Disable a user account and revoke all of its sessions (admin only)
 // @Tags			admin
 // @Accept			json
 // @Produce		json
@@ -632,28 +886,51 @@ func disableUserHandler(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(fiber.StatusOK).JSON(UserResponse{
-		ID:        user.ID,
-		Name:      user.Name,
-		Email:     user.Email,
-		Avatar:    user.Avatar,
-		Username:  user.Username,
-		Role:      user.Role,
-		Status:    user.Status,
-		CreatedAt: user.CreatedAt,
-		UpdatedAt: user.UpdatedAt,
-	})
+	// Signed in sessions and refresh tokens must stop working right away
+	if err := revokeUserSessions(user.ID); err != nil {
+		log.Warnf("Failed to revoke sessions of user %d: %v", user.ID, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(newUserResponse(user))
 }
 
 // Setup API routes
 func setupRoutes(app *fiber.App) {
+	// Only API routes are rate limited, not the frontend
+	app.Use([]string{"/auth", "/admin", "/user", "/.well-known"}, rateLimitMiddleware)
+
 	// Public routes
 	app.Post("/auth/login", loginHandler)
 	app.Post("/auth/refresh", refreshHandler)
 	app.Post("/auth/logout", logoutHandler)
+	app.Post("/auth/mfa/verify", scopedAuthMiddleware(scopeMFARequired), verifyMFAHandler)
+	app.Post("/auth/webauthn/login/begin", beginPasskeyLoginHandler)
+	app.Post("/auth/webauthn/login", passkeyLoginHandler)
+	app.Get("/.well-known/jwks.json", jwksHandler)
+	app.Post("/auth/register", registerHandler)
+	app.Get("/auth/verify-email", verifyEmailHandler)
+	app.Post("/auth/verify-email", verifyEmailHandler)
+	app.Post("/auth/verify-email/resend", resendVerificationHandler)
+	app.Post("/auth/forgot-password", forgotPasswordHandler)
+	app.Post("/auth/reset-password", resetPasswordHandler)
 
 	// Protected routes (require authentication)
 	app.Get("/user", authMiddleware, userHandler)
+	app.Patch("/user", authMiddleware, updateProfileHandler)
+	app.Get("/user/menu", authMiddleware, menuHandler)
+	app.Put("/user/password", scopedAuthMiddleware(scopePasswordChange), changePasswordHandler)
+	app.Get("/user/sessions", authMiddleware, getSessionsHandler)
+	app.Delete("/user/sessions", authMiddleware, revokeOtherSessionsHandler)
+	app.Delete("/user/sessions/:id", authMiddleware, revokeSessionHandler)
+	app.Get("/user/mfa", scopedAuthMiddleware(scopeMFAEnrollment), getMFAStatusHandler)
+	app.Post("/user/mfa/totp", scopedAuthMiddleware(scopeMFAEnrollment), enrollTOTPHandler)
+	app.Post("/user/mfa/totp/confirm", scopedAuthMiddleware(scopeMFAEnrollment), confirmTOTPHandler)
+	app.Delete("/user/mfa/totp", authMiddleware, disableTOTPHandler)
+	app.Post("/user/mfa/recovery-codes", authMiddleware, regenerateRecoveryCodesHandler)
+	app.Post("/user/webauthn/register/begin", authMiddleware, beginPasskeyRegistrationHandler)
+	app.Post("/user/webauthn/register/finish", authMiddleware, finishPasskeyRegistrationHandler)
+	app.Get("/user/webauthn/credentials", authMiddleware, getPasskeysHandler)
+	app.Delete("/user/webauthn/credentials/:id", authMiddleware, deletePasskeyHandler)
 
 	// Admin routes (require admin role)
 	admin := app.Group("/admin", authMiddleware, adminMiddleware)
@@ -664,4 +941,16 @@ func setupRoutes(app *fiber.App) {
 	admin.Delete("/users/:id", deleteUserHandler)
 	admin.Put("/users/:id/enable", enableUserHandler)
 	admin.Put("/users/:id/disable", disableUserHandler)
+	admin.Post("/users/:id/reset-password", adminResetPasswordHandler)
+	admin.Get("/users/:id/sessions", getUserSessionsHandler)
+	admin.Delete("/users/:id/sessions", revokeUserSessionsHandler)
+	admin.Delete("/users/:id/sessions/:sid", revokeUserSessionHandler)
+	admin.Delete("/users/:id/mfa", adminResetMFAHandler)
+	admin.Put("/users/:id/unlock", unlockUserHandler)
+	admin.Get("/audit-events", getAuditEventsHandler)
+	admin.Get("/menus/:role", getMenuTreeHandler)
+	admin.Put("/menus/:role", replaceMenuTreeHandler)
+	admin.Post("/menus/:role/items", createMenuItemHandler)
+	admin.Put("/menus/:role/items/:id", updateMenuItemHandler)
+	admin.Delete("/menus/:role/items/:id", deleteMenuItemHandler)
 }
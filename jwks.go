@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Size of generated RSA keys
+const rsaKeyBits = 2048
+
+// Prefix of private keys stored encrypted with JWT_KEY_ENCRYPTION_KEY
+const encryptedKeyPrefix = "enc:v1:"
+
+// Public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	Curve     string `json:"crv,omitempty"`
+	N         string `json:"n,omitempty"` // RSA modulus
+	E         string `json:"e,omitempty"` // RSA exponent
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+type JWKSResponse struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Check whether an algorithm signs with a key pair rather than a shared secret
+func isAsymmetricAlgorithm(alg string) bool {
+	return alg == "RS256" || alg == "ES256" || alg == "EdDSA"
+}
+
+// Generate a private key for an asymmetric algorithm
+func generatePrivateKey(alg string) (crypto.Signer, error) {
+	switch alg {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	default:
+		return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+}
+
+func newAsymmetricKey(id string, alg string, privateKey crypto.Signer) *SigningKey {
+	return &SigningKey{
+		ID:        id,
+		Method:    jwt.GetSigningMethod(alg),
+		SignKey:   privateKey,
+		VerifyKey: privateKey.Public(),
+	}
+}
+
+// Load the stored key pairs, generating one for the configured algorithm on
+// first boot or once the current key is older than the maximum key age. The
+// newest unretired key of the configured algorithm becomes current, all other
+// keys are retired and only verify tokens until the grace period ends.
+func loadAsymmetricKeys(ring *Keyring, alg string) error {
+	if settings.JWTKeyEncryptionKey == "" {
+		log.Warn("JWT private keys are stored unencrypted, set JWT_KEY_ENCRYPTION_KEY to encrypt them")
+	}
+
+	// Keys past their grace period cannot verify any token anymore
+	if _, err := db.Exec("DELETE FROM signing_keys WHERE expires_at < ?", time.Now()); err != nil {
+		return err
+	}
+
+	rows, err := db.Query(`
+		SELECT id, algorithm, private_key, created_at, expires_at
+		FROM signing_keys
+		ORDER BY created_at DESC, rowid DESC`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var current *SigningKey
+	unencrypted := map[string]string{}
+	for rows.Next() {
+		var id, keyAlg, storedKey string
+		var createdAt time.Time
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&id, &keyAlg, &storedKey, &createdAt, &expiresAt); err != nil {
+			return err
+		}
+
+		keyPEM, err := decryptPrivateKey(id, storedKey)
+		if err != nil {
+			return fmt.Errorf("invalid private key of JWT key %q: %w", id, err)
+		}
+		if settings.JWTKeyEncryptionKey != "" && keyPEM == storedKey {
+			unencrypted[id] = keyPEM
+		}
+
+		block, _ := pem.Decode([]byte(keyPEM))
+		if block == nil {
+			return fmt.Errorf("invalid private key of JWT key %q", id)
+		}
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("invalid private key of JWT key %q: %w", id, err)
+		}
+		privateKey, ok := parsed.(crypto.Signer)
+		if !ok {
+			return fmt.Errorf("unsupported private key of JWT key %q", id)
+		}
+
+		key := newAsymmetricKey(id, keyAlg, privateKey)
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		if err := ring.add(key); err != nil {
+			return err
+		}
+		if current == nil && keyAlg == alg && key.ExpiresAt == nil &&
+			(settings.JWTKeyMaxAge == 0 || time.Since(createdAt) < settings.JWTKeyMaxAge) {
+			current = key
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Encrypt keys stored before an encryption key was configured
+	for id, keyPEM := range unencrypted {
+		storedKey, err := encryptPrivateKey(id, keyPEM)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE signing_keys SET private_key = ? WHERE id = ?", storedKey, id); err != nil {
+			return err
+		}
+	}
+
+	if current == nil {
+		if current, err = createAsymmetricKey(alg); err != nil {
+			return err
+		}
+		if err := ring.add(current); err != nil {
+			return err
+		}
+	}
+	ring.Current = current
+
+	return retireSigningKeys(ring)
+}
+
+// Time retired keys keep verifying tokens, long enough for every token signed
+// with them to expire
+func signingKeyGracePeriod() time.Duration {
+	return max(settings.AccessTokenTTL, settings.RefreshTokenTTL, settings.RememberMeTTL, restrictedTokenTTL)
+}
+
+// Retire every stored key except the current one
+func retireSigningKeys(ring *Keyring) error {
+	expiresAt := time.Now().Add(signingKeyGracePeriod())
+	_, err := db.Exec(`
+		UPDATE signing_keys SET expires_at = ?
+		WHERE id != ? AND expires_at IS NULL`, expiresAt, ring.Current.ID)
+	if err != nil {
+		return err
+	}
+	for _, key := range ring.Keys {
+		if key == ring.Current {
+			continue
+		}
+		if !isAsymmetricAlgorithm(key.Method.Alg()) {
+			if err := retireSecret(key, expiresAt); err != nil {
+				return err
+			}
+			continue
+		}
+		if key.ExpiresAt == nil {
+			log.Infof("Retiring JWT key %q, it is accepted until %s", key.ID, expiresAt.Format(time.RFC3339))
+			key.ExpiresAt = &expiresAt
+		}
+	}
+	return nil
+}
+
+// Retire a shared secret replaced by key pairs. Secrets are configured rather
+// than stored, so the end of their grace period is stored instead, and
+// restarts do not extend it.
+func retireSecret(key *SigningKey, expiresAt time.Time) error {
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO retired_secrets (id, expires_at)
+		VALUES (?, ?)`, key.ID, expiresAt)
+	if err != nil {
+		return err
+	}
+	var retiredUntil time.Time
+	err = db.QueryRow("SELECT expires_at FROM retired_secrets WHERE id = ?", key.ID).Scan(&retiredUntil)
+	if err != nil {
+		return err
+	}
+	if key.ExpiresAt == nil || retiredUntil.Before(*key.ExpiresAt) {
+		if time.Now().Before(retiredUntil) {
+			log.Infof("Retiring JWT secret %q, it is accepted until %s", key.ID, retiredUntil.Format(time.RFC3339))
+		}
+		key.ExpiresAt = &retiredUntil
+	}
+	return nil
+}
+
+// Generate and store a new key pair
+func createAsymmetricKey(alg string) (*SigningKey, error) {
+	privateKey, err := generatePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	id, err := generateOpaqueToken()
+	if err != nil {
+		return nil, err
+	}
+	id = id[:16]
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	storedKey, err := encryptPrivateKey(id, string(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+		INSERT INTO signing_keys (id, algorithm, private_key)
+		VALUES (?, ?, ?)`, id, alg, storedKey)
+	if err != nil {
+		return nil, err
+	}
+	return newAsymmetricKey(id, alg, privateKey), nil
+}
+
+// AES-256-GCM cipher for private keys, keyed with the hashed encryption key
+func privateKeyCipher() (cipher.AEAD, error) {
+	sum := sha256.Sum256([]byte(settings.JWTKeyEncryptionKey))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt a private key for storage if an encryption key is configured. The
+// key ID is authenticated, so stored keys cannot be swapped.
+func encryptPrivateKey(id string, keyPEM string) (string, error) {
+	if settings.JWTKeyEncryptionKey == "" {
+		return keyPEM, nil
+	}
+	aead, err := privateKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(keyPEM), []byte(id))
+	return encryptedKeyPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt a stored private key, unencrypted keys are returned as they are
+func decryptPrivateKey(id string, storedKey string) (string, error) {
+	encoded, ok := strings.CutPrefix(storedKey, encryptedKeyPrefix)
+	if !ok {
+		return storedKey, nil
+	}
+	if settings.JWTKeyEncryptionKey == "" {
+		return "", fmt.Errorf("private key is encrypted but JWT_KEY_ENCRYPTION_KEY is not set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	aead, err := privateKeyCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted private key is truncated")
+	}
+	keyPEM, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt private key, wrong JWT_KEY_ENCRYPTION_KEY")
+	}
+	return string(keyPEM), nil
+}
+
+// Public keys of the keyring that can verify tokens, secrets are never included
+func (k *Keyring) PublicKeys() []JWK {
+	keys := []JWK{}
+	for _, key := range k.Keys {
+		if !key.Usable() {
+			continue
+		}
+		if jwk, ok := newJWK(key); ok {
+			keys = append(keys, jwk)
+		}
+	}
+	return keys
+}
+
+func newJWK(key *SigningKey) (JWK, bool) {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := JWK{KeyID: key.ID, Algorithm: key.Method.Alg(), Use: "sig"}
+
+	switch pub := key.VerifyKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = encode(pub.N.Bytes())
+		jwk.E = encode(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return JWK{}, false
+		}
+		// Uncompressed point: 0x04 || X || Y
+		point := ecdhKey.Bytes()[1:]
+		jwk.KeyType = "EC"
+		jwk.Curve = pub.Curve.Params().Name
+		jwk.X = encode(point[:len(point)/2])
+		jwk.Y = encode(point[len(point)/2:])
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = encode(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// GET /.well-known/jwks.json
+// JWKS godoc
+//
+//	@Summary		JSON Web Key Set
+//	@Description	Public keys to verify tokens issued by this server. Empty when tokens are signed with a shared secret.
+//	@Tags			auth
+//	@Produce		json
+//	@Success		200	{object}	JWKSResponse
+//	@Router			/.well-known/jwks.json [GET]
+func jwksHandler(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(JWKSResponse{
+		Keys: keyring.PublicKeys(),
+	})
+}
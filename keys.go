@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Shortest accepted HMAC secret
+const minJWTSecretLength = 32
+
+// A key tokens are signed or verified with, identified by the "kid" header
+type SigningKey struct {
+	ID        string
+	Method    jwt.SigningMethod
+	SignKey   interface{}
+	VerifyKey interface{}
+	ExpiresAt *time.Time // End of the grace period of a retired key, nil if unlimited
+}
+
+// Usable checks whether tokens signed with the key are still accepted
+func (k *SigningKey) Usable() bool {
+	return k.ExpiresAt == nil || time.Now().Before(*k.ExpiresAt)
+}
+
+// Keys used for JWTs. New tokens are signed with the current key, older keys
+// are only accepted for verification.
+type Keyring struct {
+	Current *SigningKey
+	Keys    map[string]*SigningKey
+}
+
+// Signing keys, set up at startup by loadKeyring
+var keyring *Keyring
+
+// Keys file read with -jwt-keys-file
+type keysFile struct {
+	Current string `json:"current"` // Key ID to sign with, defaults to the first key
+	Keys    []struct {
+		ID        string     `json:"kid"`
+		Secret    string     `json:"secret"`
+		ExpiresAt *time.Time `json:"expires_at,omitempty"` // Stop accepting the key after this time
+	} `json:"keys"`
+}
+
+func hmacKey(id string, secret string) *SigningKey {
+	return &SigningKey{
+		ID:        id,
+		Method:    jwt.SigningMethodHS256,
+		SignKey:   []byte(secret),
+		VerifyKey: []byte(secret),
+	}
+}
+
+// Create an HS256 key, rejecting secrets that are too short to be safe
+func newHMACKey(id string, secret string) (*SigningKey, error) {
+	if len(secret) < minJWTSecretLength {
+		return nil, fmt.Errorf("JWT secret %q must be at least %d characters", id, minJWTSecretLength)
+	}
+	return hmacKey(id, secret), nil
+}
+
+// Derive a key ID from a secret, so tokens keep verifying across restarts
+func secretKeyID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func (k *Keyring) add(key *SigningKey) error {
+	if _, ok := k.Keys[key.ID]; ok {
+		return fmt.Errorf("duplicate JWT key ID %q", key.ID)
+	}
+	k.Keys[key.ID] = key
+	return nil
+}
+
+// Load keys from the keys file, the JWT secret settings or the build time
+// secret, in this order. With an asymmetric algorithm, secrets are only used
+// to verify tokens issued before switching and tokens are signed with a key
+// pair stored in the database.
+func loadKeyring() (*Keyring, error) {
+	ring := &Keyring{Keys: map[string]*SigningKey{}}
+	asymmetric := isAsymmetricAlgorithm(settings.JWTAlgorithm)
+	if !asymmetric && settings.JWTAlgorithm != "HS256" {
+		return nil, fmt.Errorf("unknown JWT algorithm %q, expected HS256, RS256, ES256 or EdDSA", settings.JWTAlgorithm)
+	}
+
+	switch {
+	case settings.JWTKeysFile != "":
+		data, err := os.ReadFile(settings.JWTKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		var file keysFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, fmt.Errorf("invalid JWT keys file: %w", err)
+		}
+		for _, entry := range file.Keys {
+			if entry.ID == "" {
+				return nil, fmt.Errorf("JWT keys file contains a key without kid")
+			}
+			key, err := newHMACKey(entry.ID, entry.Secret)
+			if err != nil {
+				return nil, err
+			}
+			key.ExpiresAt = entry.ExpiresAt
+			if err := ring.add(key); err != nil {
+				return nil, err
+			}
+			if ring.Current == nil && (file.Current == "" || file.Current == entry.ID) {
+				ring.Current = key
+			}
+		}
+		if ring.Current == nil {
+			return nil, fmt.Errorf("JWT keys file has no current key %q", file.Current)
+		}
+
+	case settings.JWTSecret != "":
+		for i, secret := range append([]string{settings.JWTSecret}, settings.JWTPreviousSecrets...) {
+			key, err := newHMACKey(secretKeyID(secret), secret)
+			if err != nil {
+				return nil, err
+			}
+			if err := ring.add(key); err != nil {
+				return nil, err
+			}
+			if i == 0 {
+				ring.Current = key
+			}
+		}
+
+	case jwtSecretString == defaultJWTSecret && asymmetric:
+		// No secret needed
+
+	case jwtSecretString == defaultJWTSecret:
+		if !settings.InsecureJWTSecret {
+			return nil, fmt.Errorf("refusing to start with the default JWT secret, " +
+				"set JWT_SECRET or -jwt-keys-file, or pass -insecure-jwt-secret")
+		}
+		log.Warn("Using the default JWT secret, tokens can be forged by anyone")
+		ring.Current = hmacKey(secretKeyID(jwtSecretString), jwtSecretString)
+		ring.Keys[ring.Current.ID] = ring.Current
+
+	default:
+		// Secret set at build time
+		key, err := newHMACKey(secretKeyID(jwtSecretString), jwtSecretString)
+		if err != nil {
+			return nil, err
+		}
+		ring.Current = key
+		ring.Keys[key.ID] = key
+	}
+
+	if asymmetric {
+		if err := loadAsymmetricKeys(ring, settings.JWTAlgorithm); err != nil {
+			return nil, err
+		}
+	} else {
+		// Secrets sign tokens again after switching back to HS256
+		if _, err := db.Exec("DELETE FROM retired_secrets"); err != nil {
+			return nil, err
+		}
+	}
+
+	if !ring.Current.Usable() {
+		return nil, fmt.Errorf("current JWT key %q has expired", ring.Current.ID)
+	}
+	return ring, nil
+}
+
+// Sign claims with the current key
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.Current.Method, claims)
+	token.Header["kid"] = k.Current.ID
+	return token.SignedString(k.Current.SignKey)
+}
+
+// Find the key a token was signed with, for jwt.ParseWithClaims
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		// Tokens issued before key IDs were added
+		kid = k.Current.ID
+	}
+
+	key, ok := k.Keys[kid]
+	if !ok || !key.Usable() {
+		return nil, fmt.Errorf("unknown or expired signing key %q", kid)
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q", token.Method.Alg())
+	}
+	return key.VerifyKey, nil
+}
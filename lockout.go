@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+const (
+	loginFailureWindow        = time.Hour        // Failed logins are forgotten after this long without another one
+	maxLoginLockout           = 24 * time.Hour   // Longest lockout, however many logins failed
+	loginFailurePruneInterval = 10 * time.Minute // How often forgotten failed logins are removed
+)
+
+// Failed logins from a client IP
+type loginFailures struct {
+	Count       int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// Failed logins by client IP. Kept in memory, a restart forgets them.
+var ipLoginFailures = struct {
+	sync.Mutex
+	failures map[string]*loginFailures
+}{failures: map[string]*loginFailures{}}
+
+// Time a client has to wait after its latest failed login. Once the limit is
+// reached, the lockout doubles with every further failure.
+func loginLockoutDuration(failures int, limit int) time.Duration {
+	if limit <= 0 || failures < limit {
+		return 0
+	}
+	lockout := float64(settings.LoginLockout) * math.Pow(2, float64(failures-limit))
+	if lockout > float64(maxLoginLockout) {
+		return maxLoginLockout
+	}
+	return time.Duration(lockout)
+}
+
+// Time until a client IP may try to log in again, zero if it is not locked out
+func ipLoginRetryAfter(ip string) time.Duration {
+	ipLoginFailures.Lock()
+	defer ipLoginFailures.Unlock()
+	if failures, ok := ipLoginFailures.failures[ip]; ok {
+		return time.Until(failures.LockedUntil)
+	}
+	return 0
+}
+
+// Count a failed login from a client IP, returning the resulting lockout
+func recordIPLoginFailure(ip string) time.Duration {
+	now := time.Now()
+
+	ipLoginFailures.Lock()
+	defer ipLoginFailures.Unlock()
+	failures, ok := ipLoginFailures.failures[ip]
+	if !ok || now.Sub(failures.LastFailure) > loginFailureWindow {
+		failures = &loginFailures{}
+		ipLoginFailures.failures[ip] = failures
+	}
+	failures.Count++
+	failures.LastFailure = now
+	lockout := loginLockoutDuration(failures.Count, settings.LoginIPMaxAttempts)
+	failures.LockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// Failed logins are counted by the submitted username, whether or not a user
+// has it, so lockouts do not reveal which usernames exist. Usernames are
+// stored hashed, as unknown ones may be mistyped passwords.
+func usernameKey(username string) string {
+	return hashToken(username)
+}
+
+// Time until a username may be used to log in again, zero if it is not locked
+func usernameLoginRetryAfter(username string) (time.Duration, error) {
+	var lockedUntil sql.NullTime
+	err := db.QueryRow(`
+		SELECT locked_until FROM login_failures
+		WHERE username_hash = ?`, usernameKey(username)).Scan(&lockedUntil)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil || !lockedUntil.Valid {
+		return 0, err
+	}
+	return time.Until(lockedUntil.Time), nil
+}
+
+// Count a failed login with a username, locking it once there were too many
+func recordUsernameLoginFailure(username string) (time.Duration, error) {
+	now := time.Now()
+	key := usernameKey(username)
+	var failures int
+	err := db.QueryRow(`
+		INSERT INTO login_failures (username_hash, failed_attempts, last_failed_at)
+		VALUES (?, 1, ?)
+		ON CONFLICT (username_hash) DO UPDATE SET
+			failed_attempts = CASE
+				WHEN last_failed_at < ? THEN 1
+				ELSE failed_attempts + 1
+			END,
+			last_failed_at = excluded.last_failed_at
+		RETURNING failed_attempts`, key, now, now.Add(-loginFailureWindow)).Scan(&failures)
+	if err != nil {
+		return 0, err
+	}
+
+	lockout := loginLockoutDuration(failures, settings.LoginMaxAttempts)
+	if lockout > 0 {
+		_, err = db.Exec("UPDATE login_failures SET locked_until = ? WHERE username_hash = ?", now.Add(lockout), key)
+	}
+	return lockout, err
+}
+
+// Forget the failed logins with a username, after a successful login or an admin unlock
+func resetUsernameLoginFailures(username string) error {
+	_, err := db.Exec("DELETE FROM login_failures WHERE username_hash = ?", usernameKey(username))
+	return err
+}
+
+// Forget failed logins that no longer count and whose lockout is over
+func pruneLoginFailures() (int64, error) {
+	now := time.Now()
+
+	ipLoginFailures.Lock()
+	for ip, failures := range ipLoginFailures.failures {
+		if now.Sub(failures.LastFailure) > loginFailureWindow && now.After(failures.LockedUntil) {
+			delete(ipLoginFailures.failures, ip)
+		}
+	}
+	ipLoginFailures.Unlock()
+
+	result, err := db.Exec(`
+		DELETE FROM login_failures
+		WHERE last_failed_at < ? AND (locked_until IS NULL OR locked_until < ?)`, now.Add(-loginFailureWindow), now)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Periodically prune failed logins, by IP and by username
+func startLoginFailurePruner() {
+	go func() {
+		ticker := time.NewTicker(loginFailurePruneInterval)
+		defer ticker.Stop()
+		for {
+			if n, err := pruneLoginFailures(); err != nil {
+				log.Warnf("Failed to prune failed logins: %v", err)
+			} else if n > 0 {
+				log.Debugf("Pruned %d failed login records", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Reject a login attempt that has to wait, with the seconds to wait in Retry-After
+func tooManyLoginAttempts(c *fiber.Ctx, retryAfter time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, headerSeconds(retryAfter))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error": "Too many failed login attempts, try again later",
+	})
+}
+
+// Count a failed login with a wrong password, an unknown username or a wrong
+// second factor, for both the client IP and the username. The user ID is zero
+// for unknown usernames.
+func recordLoginFailure(c *fiber.Ctx, userID int, username string) error {
+	ip := c.IP()
+	logRequestSecurityEvent(c, "login_failed", userID, "failed login as "+username)
+	if lockout := recordIPLoginFailure(ip); lockout > 0 {
+		logRequestSecurityEvent(c, "ip_throttled", userID, fmt.Sprintf("logins from %s blocked for %s", ip, lockout))
+	}
+
+	lockout, err := recordUsernameLoginFailure(username)
+	if err != nil {
+		return err
+	}
+	if lockout > 0 {
+		logRequestSecurityEvent(c, "account_locked", userID, fmt.Sprintf("logins as %s blocked for %s", username, lockout))
+	}
+	return nil
+}
+
+// PUT /admin/users/:id/unlock
+// Unlock user (admin only)
+// @Summary		Unlock user
+// @Description	Lift the lockout of an account after too many failed logins and reset its failed login count (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			id	path		int	true	"User ID"
+// @Success		200	{object}	SuccessResponse	"Account unlocked message"
+// @Failure		400	{object}	ErrorResponse	"Invalid user ID"
+// @Failure		404	{object}	ErrorResponse	"User not found"
+// @Failure		500	{object}	ErrorResponse	"Failed to unlock user"
+// @Router			/admin/users/{id}/unlock [PUT]
+func unlockUserHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid user ID",
+		})
+	}
+
+	user, err := getUserByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to unlock user",
+		})
+	}
+
+	if err := resetUsernameLoginFailures(user.Username); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to unlock user",
+		})
+	}
+	logRequestSecurityEvent(c, "account_unlocked", id, fmt.Sprintf("unlocked by admin %d", c.Locals("userID").(int)))
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "User unlocked successfully",
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestLoginLockoutDuration(t *testing.T) {
+	lockout := settings.LoginLockout
+	t.Cleanup(func() { settings.LoginLockout = lockout })
+	settings.LoginLockout = 15 * time.Minute
+
+	tests := []struct {
+		name     string
+		failures int
+		limit    int
+		want     time.Duration
+	}{
+		{"disabled", 100, 0, 0},
+		{"no failures", 0, 5, 0},
+		{"below the limit", 4, 5, 0},
+		{"at the limit", 5, 5, 15 * time.Minute},
+		{"one past the limit", 6, 5, 30 * time.Minute},
+		{"three past the limit", 8, 5, 2 * time.Hour},
+		{"just below the cap", 11, 5, 16 * time.Hour},
+		{"capped", 12, 5, maxLoginLockout},
+		{"far past the cap", 5000, 5, maxLoginLockout},
+		{"limit of one", 1, 1, 15 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := loginLockoutDuration(tt.failures, tt.limit); got != tt.want {
+				t.Errorf("loginLockoutDuration(%d, %d) = %s, want %s", tt.failures, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownUsernameLockout(t *testing.T) {
+	maxAttempts, lockout := settings.LoginMaxAttempts, settings.LoginLockout
+	t.Cleanup(func() {
+		settings.LoginMaxAttempts, settings.LoginLockout = maxAttempts, lockout
+	})
+	settings.LoginMaxAttempts = 3
+	settings.LoginLockout = time.Minute
+
+	const username = "no-such-user"
+	t.Cleanup(func() { resetUsernameLoginFailures(username) })
+	login := LoginRequest{Username: username, Password: "wrong-password"}
+	for i := 1; i <= settings.LoginMaxAttempts; i++ {
+		if status, body := testRequest(t, "/auth/login", "", login); status != fiber.StatusUnauthorized {
+			t.Fatalf("failed login %d: status %d: %v", i, status, body)
+		}
+	}
+	if status, body := testRequest(t, "/auth/login", "", login); status != fiber.StatusTooManyRequests {
+		t.Fatalf("login after %d failures: status %d: %v", settings.LoginMaxAttempts, status, body)
+	}
+
+	// Failures are stored by the hash of the username only
+	var failures int
+	err := db.QueryRow("SELECT failed_attempts FROM login_failures WHERE username_hash = ?", usernameKey(username)).Scan(&failures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != settings.LoginMaxAttempts {
+		t.Errorf("failed_attempts = %d, want %d", failures, settings.LoginMaxAttempts)
+	}
+	var plain int
+	if err := db.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username_hash = ?", username).Scan(&plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain != 0 {
+		t.Error("username stored in plain text")
+	}
+
+	if retryAfter, err := usernameLoginRetryAfter(username); err != nil || retryAfter <= 0 || retryAfter > time.Minute {
+		t.Errorf("usernameLoginRetryAfter = %s, %v, want up to %s", retryAfter, err, time.Minute)
+	}
+	if err := resetUsernameLoginFailures(username); err != nil {
+		t.Fatal(err)
+	}
+	if retryAfter, err := usernameLoginRetryAfter(username); err != nil || retryAfter != 0 {
+		t.Errorf("usernameLoginRetryAfter after reset = %s, %v, want 0", retryAfter, err)
+	}
+}
+
+func TestPruneLoginFailures(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-2 * loginFailureWindow)
+	rows := []struct {
+		username    string
+		lastFailed  time.Time
+		lockedUntil sql.NullTime
+		pruned      bool
+	}{
+		{"prune-old", old, sql.NullTime{}, true},
+		{"prune-lockout-over", old, sql.NullTime{Time: now.Add(-time.Minute), Valid: true}, true},
+		{"keep-locked", old, sql.NullTime{Time: now.Add(time.Hour), Valid: true}, false},
+		{"keep-recent", now.Add(-time.Minute), sql.NullTime{}, false},
+	}
+	for _, row := range rows {
+		_, err := db.Exec(`
+			INSERT INTO login_failures (username_hash, failed_attempts, last_failed_at, locked_until)
+			VALUES (?, 1, ?, ?)`, usernameKey(row.username), row.lastFailed, row.lockedUntil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resetUsernameLoginFailures(row.username) })
+	}
+
+	ips := []struct {
+		ip       string
+		failures loginFailures
+		pruned   bool
+	}{
+		{"192.0.2.1", loginFailures{Count: 1, LastFailure: old, LockedUntil: old}, true},
+		{"192.0.2.2", loginFailures{Count: 30, LastFailure: old, LockedUntil: now.Add(time.Hour)}, false},
+		{"192.0.2.3", loginFailures{Count: 1, LastFailure: now, LockedUntil: now}, false},
+	}
+	ipLoginFailures.Lock()
+	for _, entry := range ips {
+		failures := entry.failures
+		ipLoginFailures.failures[entry.ip] = &failures
+	}
+	ipLoginFailures.Unlock()
+	t.Cleanup(func() {
+		ipLoginFailures.Lock()
+		defer ipLoginFailures.Unlock()
+		for _, entry := range ips {
+			delete(ipLoginFailures.failures, entry.ip)
+		}
+	})
+
+	if _, err := pruneLoginFailures(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, row := range rows {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM login_failures WHERE username_hash = ?", usernameKey(row.username)).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		if pruned := count == 0; pruned != row.pruned {
+			t.Errorf("%s: pruned = %v, want %v", row.username, pruned, row.pruned)
+		}
+	}
+	ipLoginFailures.Lock()
+	defer ipLoginFailures.Unlock()
+	for _, entry := range ips {
+		_, ok := ipLoginFailures.failures[entry.ip]
+		if pruned := !ok; pruned != entry.pruned {
+			t.Errorf("%s: pruned = %v, want %v", entry.ip, pruned, entry.pruned)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+type MailMessage struct {
+	To      string
+	Subject string
+	Body    string // Plain text body
+}
+
+// Mailer delivers outgoing emails
+type Mailer interface {
+	Send(msg MailMessage) error
+}
+
+// Mailer sending through an SMTP server, using STARTTLS when the server offers it
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string // Authentication is skipped when empty
+	Password string
+	From     string
+}
+
+func (m *SMTPMailer) Send(msg MailMessage) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	addr := net.JoinHostPort(m.Host, m.Port)
+	return smtp.SendMail(addr, auth, m.From, []string{msg.To}, buildMailMessage(m.From, msg))
+}
+
+// Mailer writing every message as an .eml file into a directory, for testing
+// and offline use
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg MailMessage) error {
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	suffix, err := generateOpaqueToken()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405"), suffix[:8])
+	return os.WriteFile(filepath.Join(m.Dir, name), buildMailMessage(m.From, msg), 0o600)
+}
+
+// Outgoing mail transport, nil when no transport is configured
+var mailer Mailer
+
+// Create the mailer for the configured transport
+func newMailer() (Mailer, error) {
+	switch settings.MailTransport {
+	case "":
+		return nil, nil
+	case "smtp":
+		if settings.SMTPHost == "" {
+			return nil, fmt.Errorf("smtp mail transport requires an SMTP host")
+		}
+		return &SMTPMailer{
+			Host:     settings.SMTPHost,
+			Port:     settings.SMTPPort,
+			Username: settings.SMTPUsername,
+			Password: settings.SMTPPassword,
+			From:     settings.MailFrom,
+		}, nil
+	case "file":
+		return &FileMailer{
+			Dir:  settings.MailDir,
+			From: settings.MailFrom,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q, expected 'smtp' or 'file'", settings.MailTransport)
+	}
+}
+
+// Number of background mail jobs that can wait for the worker, further
+// jobs are dropped
+const mailQueueSize = 100
+
+// Background jobs preparing and sending mail, run one at a time
+var mailJobs = make(chan func(), mailQueueSize)
+
+// Run queued mail jobs in the background
+func startMailWorker() {
+	go func() {
+		for job := range mailJobs {
+			job()
+		}
+	}()
+}
+
+// Queue a job that sends mail, so the request does not wait for it
+func enqueueMailJob(job func()) {
+	select {
+	case mailJobs <- job:
+	default:
+		log.Warn("Mail queue is full, dropping mail job")
+	}
+}
+
+// Send an email through the configured mailer
+func sendMail(msg MailMessage) error {
+	if mailer == nil {
+		log.Warnf("No mail transport configured, dropping mail %q to %s", msg.Subject, msg.To)
+		return nil
+	}
+	return mailer.Send(msg)
+}
+
+// Build an RFC 5322 plain text message
+func buildMailMessage(from string, msg MailMessage) []byte {
+	var buf bytes.Buffer
+	id, _ := generateOpaqueToken()
+	fmt.Fprintf(&buf, "From: %s\r\n", mailHeaderValue(from))
+	fmt.Fprintf(&buf, "To: %s\r\n", mailHeaderValue(msg.To))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", mailHeaderValue(msg.Subject)))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@webadmin>\r\n", id)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// Strip line breaks so user supplied values cannot inject extra headers
+func mailHeaderValue(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
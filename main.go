@@ -7,6 +7,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	_ "webadmin/docs"
@@ -17,11 +19,138 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/fiber/v2/middleware/monitor"
 	"github.com/gofiber/swagger"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 //go:embed dist/ng-matero/browser/*
 var embeddedFiles embed.FS
 
+// Server settings used by the API handlers
+type Settings struct {
+	RegistrationEnabled    bool     // Allow self-service registration at /auth/register
+	RegistrationDomains    []string // Email domains allowed to register, empty allows any
+	RegistrationApproval   bool     // Create registered accounts as pending until an admin enables them
+	PublicURL              string   // Base URL used in links sent to users
+	MailTransport          string   // "smtp", "file" or empty to disable outgoing mail
+	MailFrom               string
+	MailDir                string // Output directory of the file mail transport
+	SMTPHost               string
+	SMTPPort               string
+	SMTPUsername           string
+	SMTPPassword           string
+	StrictAuth             bool          // Check status and role of the user on every authenticated request
+	JWTKeysFile            string        // JSON file with the JWT signing keys, see keysFile
+	JWTSecret              string        // Secret to sign JWTs with, when no keys file is given
+	JWTPreviousSecrets     []string      // Retired secrets still accepted for verification
+	InsecureJWTSecret      bool          // Allow starting with the default JWT secret
+	JWTAlgorithm           string        // HS256, or RS256, ES256 or EdDSA with generated key pairs
+	JWTKeyMaxAge           time.Duration // Age after which a new key pair is generated at startup, 0 for never
+	JWTKeyEncryptionKey    string        // Key to encrypt stored private keys with, empty stores them unencrypted
+	JWTIssuer              string        // "iss" claim of issued tokens, required on validation
+	JWTAudience            string        // "aud" claim of issued tokens, required on validation
+	AccessTokenTTL         time.Duration // Lifetime of access tokens, and of sessions without remember me
+	RefreshTokenTTL        time.Duration // Lifetime of refresh tokens issued when refreshing
+	RememberMeTTL          time.Duration // Lifetime of the refresh token issued at a remember me login
+	SessionMaxLifetime     time.Duration // Time after login refreshes stop working, 0 for unlimited
+	MFARequiredRoles       []string      // Roles that must use two-factor authentication, "*" for all
+	MFAGracePeriod         time.Duration // Time users get to enroll once two-factor authentication is required
+	WebAuthnRPID           string        // Relying party ID of passkeys, defaults to the host of the public URL
+	WebAuthnOrigins        []string      // Origins passkeys are used from, defaults to the public URL
+	LoginMaxAttempts       int           // Failed logins before an account is locked, 0 to disable
+	LoginIPMaxAttempts     int           // Failed logins before a client IP is throttled, 0 to disable
+	LoginLockout           time.Duration // First lockout, doubled with every further failure
+	RateLimitAuth          RateLimit     // Budget of each client for /auth routes
+	RateLimitAdmin         RateLimit     // Budget of each client for /admin routes
+	RateLimitDefault       RateLimit     // Budget of each client for all other routes
+	RateLimitAPIKeyHeader  string        // Header with an API key to count requests by, empty to ignore
+	RateLimitAPIKeys       []string      // API keys counted by key, requests with other keys are counted by IP
+	TrustedProxies         []string      // IPs or CIDR ranges of reverse proxies whose ProxyHeader is trusted
+	ProxyHeader            string        // Header trusted proxies put the client IP in
+	PasswordMinLength      int           // Minimum number of characters of new passwords
+	PasswordMinClasses     int           // Character classes new passwords must contain, 0 to 4
+	BreachedPasswordFile   string        // Sorted SHA-1 hash list of breached passwords, see BreachedPasswordList
+	BreachedPasswordAction string        // "reject" breached passwords, or only "warn" in the response and the audit trail
+	PasswordHistory        int           // Number of recent passwords, including the current one, that cannot be reused
+	PasswordMaxAge         time.Duration // Time after which passwords have to be changed, 0 for never
+}
+
+var settings Settings
+
+// Read a string setting from its flag, falling back to an environment variable
+func stringSetting(value string, env string) string {
+	if value == "" {
+		value = os.Getenv(env)
+	}
+	return value
+}
+
+// Read a boolean setting from its flag, falling back to an environment variable
+func boolSetting(value bool, env string) bool {
+	return value || os.Getenv(env) == "true"
+}
+
+// Read an integer setting from its flag, falling back to an environment variable
+// and then to the default
+func intSetting(value string, env string, defaultValue int) int {
+	value = stringSetting(value, env)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Fatalf("Invalid number %q for %s", value, env)
+	}
+	return n
+}
+
+// Read a duration setting from its flag, falling back to an environment variable
+// and then to the default. Besides Go durations, whole days like "7d" are accepted.
+func durationSetting(value string, env string, defaultValue time.Duration) time.Duration {
+	value = stringSetting(value, env)
+	if value == "" {
+		return defaultValue
+	}
+
+	var duration time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		duration, err = time.ParseDuration(value)
+	}
+	if err != nil || duration < 0 {
+		log.Fatalf("Invalid duration %q for %s", value, env)
+	}
+	return duration
+}
+
+// Read a rate limit setting like "20/1m" from its flag, falling back to an
+// environment variable and then to the default
+func rateLimitSetting(value string, env string, defaultValue string) RateLimit {
+	value = stringSetting(value, env)
+	if value == "" {
+		value = defaultValue
+	}
+	limit, err := parseRateLimit(value)
+	if err != nil {
+		log.Fatalf("%v for %s", err, env)
+	}
+	return limit
+}
+
+// Split a comma separated setting into its trimmed, non-empty values
+func listSetting(value string) []string {
+	var values []string
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
+
 // parse command-line flags
 func parseFlags() (string, string, bool, bool, bool) {
 	portFlag := flag.String("port", "", "Port to run the server on")
@@ -29,6 +158,51 @@ func parseFlags() (string, string, bool, bool, bool) {
 	verboseFlag := flag.Bool("verbose", false, "Enable verbose mode")
 	metricsFlag := flag.Bool("metrics", false, "Enable metrics endpoint")
 	swaggerFlag := flag.Bool("swagger", false, "Enable swagger endpoint")
+	registrationFlag := flag.Bool("registration", false, "Enable self-service registration")
+	registrationDomainsFlag := flag.String("registration-domains", "", "Comma separated email domains allowed to register")
+	registrationApprovalFlag := flag.Bool("registration-approval", false, "Require admin approval of registered accounts")
+	publicURLFlag := flag.String("public-url", "", "Public base URL used in emailed links")
+	mailTransportFlag := flag.String("mail-transport", "", "Mail transport: smtp or file (disabled when empty)")
+	mailFromFlag := flag.String("mail-from", "", "Sender address of outgoing mail")
+	mailDirFlag := flag.String("mail-dir", "", "Directory the file mail transport writes .eml files to")
+	smtpHostFlag := flag.String("smtp-host", "", "SMTP server host")
+	smtpPortFlag := flag.String("smtp-port", "", "SMTP server port")
+	smtpUsernameFlag := flag.String("smtp-username", "", "SMTP username")
+	smtpPasswordFlag := flag.String("smtp-password", "", "SMTP password")
+	strictAuthFlag := flag.Bool("strict-auth", false, "Check user status and role on every authenticated request")
+	jwtKeysFileFlag := flag.String("jwt-keys-file", "", "JSON file with the JWT signing keys")
+	jwtSecretFlag := flag.String("jwt-secret", "", "Secret to sign JWTs with")
+	jwtPreviousSecretsFlag := flag.String("jwt-previous-secrets", "", "Comma separated retired JWT secrets still accepted")
+	insecureJWTSecretFlag := flag.Bool("insecure-jwt-secret", false, "Allow running with the default JWT secret")
+	jwtAlgorithmFlag := flag.String("jwt-algorithm", "", "JWT signing algorithm: HS256, RS256, ES256 or EdDSA")
+	jwtKeyMaxAgeFlag := flag.String("jwt-key-max-age", "", "Age after which a new JWT key pair is generated at startup, e.g. 90d (never when empty)")
+	jwtKeyEncryptionKeyFlag := flag.String("jwt-key-encryption-key", "", "Key to encrypt stored JWT private keys with")
+	jwtIssuerFlag := flag.String("jwt-issuer", "", "Issuer of JWTs, defaults to the public URL")
+	jwtAudienceFlag := flag.String("jwt-audience", "", "Audience of JWTs")
+	accessTokenTTLFlag := flag.String("access-token-ttl", "", "Lifetime of access tokens, e.g. 15m or 24h")
+	refreshTokenTTLFlag := flag.String("refresh-token-ttl", "", "Lifetime of refresh tokens issued on refresh, e.g. 7d")
+	rememberMeTTLFlag := flag.String("remember-me-ttl", "", "Lifetime of remember me logins until the first refresh, e.g. 7d")
+	sessionMaxLifetimeFlag := flag.String("session-max-lifetime", "", "Absolute lifetime of sessions that refreshes cannot extend, e.g. 30d (unlimited when empty)")
+	mfaRequiredRolesFlag := flag.String("mfa-required-roles", "", "Comma separated roles that must use two-factor authentication, * for all")
+	mfaGracePeriodFlag := flag.String("mfa-grace-period", "", "Time users get to enroll in two-factor authentication, e.g. 7d")
+	webAuthnRPIDFlag := flag.String("webauthn-rp-id", "", "WebAuthn relying party ID, defaults to the host of the public URL")
+	webAuthnOriginsFlag := flag.String("webauthn-origins", "", "Comma separated origins allowed to use passkeys, defaults to the public URL")
+	loginMaxAttemptsFlag := flag.String("login-max-attempts", "", "Failed logins before an account is locked, 0 to disable (default 5)")
+	loginIPMaxAttemptsFlag := flag.String("login-ip-max-attempts", "", "Failed logins before a client IP is throttled, 0 to disable (default 20)")
+	loginLockoutFlag := flag.String("login-lockout", "", "First lockout after too many failed logins, doubled with every further failure, e.g. 15m")
+	rateLimitAuthFlag := flag.String("rate-limit-auth", "", "Requests per client to /auth routes, e.g. 20/1m, or off (default 20/1m)")
+	rateLimitAdminFlag := flag.String("rate-limit-admin", "", "Requests per client to /admin routes, e.g. 300/1m, or off (default 300/1m)")
+	rateLimitDefaultFlag := flag.String("rate-limit-default", "", "Requests per client to all other routes, e.g. 600/1m, or off (default 600/1m)")
+	rateLimitAPIKeyHeaderFlag := flag.String("rate-limit-api-key-header", "", "Header with an API key to rate limit by, see -rate-limit-api-keys")
+	rateLimitAPIKeysFlag := flag.String("rate-limit-api-keys", "", "Comma separated API keys rate limited by key instead of by client IP")
+	trustedProxiesFlag := flag.String("trusted-proxies", "", "Comma separated IPs or CIDR ranges of reverse proxies allowed to set the client IP")
+	proxyHeaderFlag := flag.String("proxy-header", "", "Header trusted proxies put the client IP in (default X-Forwarded-For)")
+	passwordMinLengthFlag := flag.String("password-min-length", "", "Minimum length of new passwords (default 8)")
+	passwordMinClassesFlag := flag.String("password-min-classes", "", "Character classes (lower, upper, digits, symbols) new passwords must contain (default 0)")
+	breachedPasswordFileFlag := flag.String("breached-password-file", "", "Sorted SHA-1 hash list of breached passwords to check new passwords against")
+	breachedPasswordActionFlag := flag.String("breached-password-action", "", "What to do with breached passwords: reject or warn (default reject)")
+	passwordHistoryFlag := flag.String("password-history", "", "Number of recent passwords that cannot be reused, 0 to allow any (default 0)")
+	passwordMaxAgeFlag := flag.String("password-max-age", "", "Time after which passwords have to be changed, e.g. 90d (never when empty)")
 	flag.Parse()
 
 	// Determine the port to use
@@ -72,6 +246,112 @@ func parseFlags() (string, string, bool, bool, bool) {
 			enableSwagger = true
 		}
 	}
+
+	// Determine the registration settings
+	settings.RegistrationEnabled = boolSetting(*registrationFlag, "registration")
+	settings.RegistrationDomains = listSetting(stringSetting(*registrationDomainsFlag, "REGISTRATION_DOMAINS"))
+	settings.RegistrationApproval = boolSetting(*registrationApprovalFlag, "registration_approval")
+
+	// Determine the mail settings
+	settings.PublicURL = strings.TrimSuffix(stringSetting(*publicURLFlag, "PUBLIC_URL"), "/")
+	if settings.PublicURL == "" {
+		settings.PublicURL = "http://localhost:" + port
+	}
+	settings.MailTransport = stringSetting(*mailTransportFlag, "MAIL_TRANSPORT")
+	settings.MailFrom = stringSetting(*mailFromFlag, "MAIL_FROM")
+	if settings.MailFrom == "" {
+		settings.MailFrom = "webadmin@localhost"
+	}
+	settings.MailDir = stringSetting(*mailDirFlag, "MAIL_DIR")
+	if settings.MailDir == "" {
+		settings.MailDir = "mail"
+	}
+	settings.SMTPHost = stringSetting(*smtpHostFlag, "SMTP_HOST")
+	settings.SMTPPort = stringSetting(*smtpPortFlag, "SMTP_PORT")
+	if settings.SMTPPort == "" {
+		settings.SMTPPort = "25"
+	}
+	settings.SMTPUsername = stringSetting(*smtpUsernameFlag, "SMTP_USERNAME")
+	settings.SMTPPassword = stringSetting(*smtpPasswordFlag, "SMTP_PASSWORD")
+
+	// Determine the authentication settings
+	settings.StrictAuth = boolSetting(*strictAuthFlag, "strict_auth")
+	settings.JWTKeysFile = stringSetting(*jwtKeysFileFlag, "JWT_KEYS_FILE")
+	settings.JWTSecret = stringSetting(*jwtSecretFlag, "JWT_SECRET")
+	settings.JWTPreviousSecrets = listSetting(stringSetting(*jwtPreviousSecretsFlag, "JWT_PREVIOUS_SECRETS"))
+	settings.InsecureJWTSecret = boolSetting(*insecureJWTSecretFlag, "insecure_jwt_secret")
+	settings.JWTAlgorithm = stringSetting(*jwtAlgorithmFlag, "JWT_ALGORITHM")
+	if settings.JWTAlgorithm == "" {
+		settings.JWTAlgorithm = "HS256"
+	}
+	settings.JWTKeyMaxAge = durationSetting(*jwtKeyMaxAgeFlag, "JWT_KEY_MAX_AGE", 0)
+	settings.JWTKeyEncryptionKey = stringSetting(*jwtKeyEncryptionKeyFlag, "JWT_KEY_ENCRYPTION_KEY")
+	if settings.JWTKeyEncryptionKey != "" && len(settings.JWTKeyEncryptionKey) < minJWTSecretLength {
+		log.Fatalf("JWT_KEY_ENCRYPTION_KEY must be at least %d characters", minJWTSecretLength)
+	}
+	settings.JWTIssuer = stringSetting(*jwtIssuerFlag, "JWT_ISSUER")
+	if settings.JWTIssuer == "" {
+		settings.JWTIssuer = settings.PublicURL
+	}
+	settings.JWTAudience = stringSetting(*jwtAudienceFlag, "JWT_AUDIENCE")
+	if settings.JWTAudience == "" {
+		settings.JWTAudience = "webadmin"
+	}
+
+	// Determine the token lifetimes
+	settings.AccessTokenTTL = durationSetting(*accessTokenTTLFlag, "ACCESS_TOKEN_TTL", 24*time.Hour)
+	settings.RefreshTokenTTL = durationSetting(*refreshTokenTTLFlag, "REFRESH_TOKEN_TTL", 7*24*time.Hour)
+	settings.RememberMeTTL = durationSetting(*rememberMeTTLFlag, "REMEMBER_ME_TTL", 7*24*time.Hour)
+	settings.SessionMaxLifetime = durationSetting(*sessionMaxLifetimeFlag, "SESSION_MAX_LIFETIME", 0)
+	if settings.AccessTokenTTL == 0 || settings.RefreshTokenTTL == 0 || settings.RememberMeTTL == 0 {
+		log.Fatalf("Token lifetimes must be greater than zero")
+	}
+
+	// Determine the two-factor authentication policy
+	settings.MFARequiredRoles = listSetting(stringSetting(*mfaRequiredRolesFlag, "MFA_REQUIRED_ROLES"))
+	settings.MFAGracePeriod = durationSetting(*mfaGracePeriodFlag, "MFA_GRACE_PERIOD", 7*24*time.Hour)
+
+	// Determine the passkey settings
+	settings.WebAuthnRPID = stringSetting(*webAuthnRPIDFlag, "WEBAUTHN_RP_ID")
+	settings.WebAuthnOrigins = listSetting(stringSetting(*webAuthnOriginsFlag, "WEBAUTHN_ORIGINS"))
+
+	// Determine the brute-force protection of logins
+	settings.LoginMaxAttempts = intSetting(*loginMaxAttemptsFlag, "LOGIN_MAX_ATTEMPTS", 5)
+	settings.LoginIPMaxAttempts = intSetting(*loginIPMaxAttemptsFlag, "LOGIN_IP_MAX_ATTEMPTS", 20)
+	settings.LoginLockout = durationSetting(*loginLockoutFlag, "LOGIN_LOCKOUT", 15*time.Minute)
+
+	// Determine the rate limits
+	settings.RateLimitAuth = rateLimitSetting(*rateLimitAuthFlag, "RATE_LIMIT_AUTH", "20/1m")
+	settings.RateLimitAdmin = rateLimitSetting(*rateLimitAdminFlag, "RATE_LIMIT_ADMIN", "300/1m")
+	settings.RateLimitDefault = rateLimitSetting(*rateLimitDefaultFlag, "RATE_LIMIT_DEFAULT", "600/1m")
+	settings.RateLimitAPIKeyHeader = stringSetting(*rateLimitAPIKeyHeaderFlag, "RATE_LIMIT_API_KEY_HEADER")
+	settings.RateLimitAPIKeys = listSetting(stringSetting(*rateLimitAPIKeysFlag, "RATE_LIMIT_API_KEYS"))
+
+	// Determine the reverse proxies the client IP is taken from, for rate
+	// limits, login lockouts, sessions and the audit trail
+	settings.TrustedProxies = listSetting(stringSetting(*trustedProxiesFlag, "TRUSTED_PROXIES"))
+	settings.ProxyHeader = stringSetting(*proxyHeaderFlag, "PROXY_HEADER")
+	if settings.ProxyHeader == "" {
+		settings.ProxyHeader = fiber.HeaderXForwardedFor
+	}
+
+	// Determine the password policy
+	settings.PasswordMinLength = intSetting(*passwordMinLengthFlag, "PASSWORD_MIN_LENGTH", 8)
+	settings.PasswordMinClasses = intSetting(*passwordMinClassesFlag, "PASSWORD_MIN_CLASSES", 0)
+	if settings.PasswordMinClasses > 4 {
+		log.Fatalf("PASSWORD_MIN_CLASSES must be between 0 and 4")
+	}
+	settings.BreachedPasswordFile = stringSetting(*breachedPasswordFileFlag, "BREACHED_PASSWORD_FILE")
+	settings.BreachedPasswordAction = stringSetting(*breachedPasswordActionFlag, "BREACHED_PASSWORD_ACTION")
+	if settings.BreachedPasswordAction == "" {
+		settings.BreachedPasswordAction = "reject"
+	}
+	if settings.BreachedPasswordAction != "reject" && settings.BreachedPasswordAction != "warn" {
+		log.Fatalf("BREACHED_PASSWORD_ACTION must be reject or warn")
+	}
+	settings.PasswordHistory = intSetting(*passwordHistoryFlag, "PASSWORD_HISTORY", 0)
+	settings.PasswordMaxAge = durationSetting(*passwordMaxAgeFlag, "PASSWORD_MAX_AGE", 0)
+
 	return port, sqlitePath, verbose, enableMetrics, enableSwagger
 }
 
@@ -83,6 +363,48 @@ func serveAdminApp(port string, sqlitePath string, verbose bool, enableMetrics b
 	}
 	defer db.Close()
 
+	// Issued tokens carry iat, nbf and exp with millisecond precision, so a
+	// token issued right after revoking a user's tokens is not mistaken for
+	// one issued before, see isTokenRevoked
+	jwt.TimePrecision = time.Millisecond
+
+	// Load JWT signing keys
+	var err error
+	keyring, err = loadKeyring()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
+	// Initialize outgoing mail
+	mailer, err = newMailer()
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+	startMailWorker()
+
+	// Load the breached password list
+	if settings.BreachedPasswordFile != "" {
+		breachedPasswords, err = openBreachedPasswordList(settings.BreachedPasswordFile)
+		if err != nil {
+			log.Fatalf("Failed to load breached password list: %v", err)
+		}
+	}
+
+	// Initialize passkeys
+	webAuthn, err = newWebAuthn()
+	if err != nil {
+		log.Fatalf("Failed to initialize WebAuthn: %v", err)
+	}
+
+	// Keep the access token denylist small
+	startRevokedTokenPruner()
+
+	// Keep the sessions table small
+	startSessionPruner()
+
+	// Forget old failed logins
+	startLoginFailurePruner()
+
 	// Create a subdirectory file system for `dist/ng-matero/browser`
 	subFS, err := fs.Sub(embeddedFiles, "dist/ng-matero/browser")
 	if err != nil {
@@ -101,6 +423,14 @@ func serveAdminApp(port string, sqlitePath string, verbose bool, enableMetrics b
 	if verbose {
 		config.DisableStartupMessage = false
 	}
+	// Without trusted proxies c.IP() is the address of the connection, so
+	// clients cannot pick their IP with a header
+	if len(settings.TrustedProxies) > 0 {
+		config.ProxyHeader = settings.ProxyHeader
+		config.EnableTrustedProxyCheck = true
+		config.TrustedProxies = settings.TrustedProxies
+		config.EnableIPValidation = true
+	}
 	app := fiber.New(config)
 
 	// Add CORS middleware
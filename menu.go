@@ -0,0 +1,842 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// Directory inside the embedded bundle holding the default menu-<role>.json files
+const menuSeedDir = "dist/ng-matero/browser/data"
+
+// Roles that get a default menu seeded on first start
+var menuSeedRoles = []string{"admin", "user"}
+
+// Menu item types understood by the frontend
+var menuTypes = map[string]bool{"link": true, "sub": true, "extLink": true, "extTabLink": true}
+
+type Menu struct {
+	ID         int
+	Role       string
+	ParentID   sql.NullInt64
+	Position   int
+	Route      string
+	Name       string
+	Type       string // "link", "sub", "extLink" or "extTabLink"
+	Icon       string
+	LabelColor string
+	LabelValue string
+	BadgeColor string
+	BadgeValue string
+	Hidden     bool
+}
+
+type MenuTag struct {
+	Color string `json:"color"`
+	Value string `json:"value"`
+}
+
+type MenuItem struct {
+	Route    string     `json:"route"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	Icon     string     `json:"icon,omitempty"`
+	Label    *MenuTag   `json:"label,omitempty"`
+	Badge    *MenuTag   `json:"badge,omitempty"`
+	Children []MenuItem `json:"children,omitempty"`
+}
+
+type MenuResponse struct {
+	Menu []MenuItem `json:"menu"`
+}
+
+// Menu item as seen by admins, including hidden items and tree positions
+type MenuNode struct {
+	ID       int        `json:"id"`
+	ParentID *int       `json:"parent_id"`
+	Position int        `json:"position"`
+	Route    string     `json:"route"`
+	Name     string     `json:"name"`
+	Type     string     `json:"type"`
+	Icon     string     `json:"icon,omitempty"`
+	Label    *MenuTag   `json:"label,omitempty"`
+	Badge    *MenuTag   `json:"badge,omitempty"`
+	Hidden   bool       `json:"hidden"`
+	Children []MenuNode `json:"children,omitempty"`
+}
+
+type MenuTreeRequest struct {
+	Menu []MenuNode `json:"menu"`
+}
+
+type MenuTreeResponse struct {
+	Role string     `json:"role"`
+	Menu []MenuNode `json:"menu"`
+}
+
+type MenuItemRequest struct {
+	ParentID *int     `json:"parent_id"`
+	Position *int     `json:"position,omitempty"` // Defaults to the end of the parent's children
+	Route    string   `json:"route"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Icon     string   `json:"icon,omitempty"`
+	Label    *MenuTag `json:"label,omitempty"`
+	Badge    *MenuTag `json:"badge,omitempty"`
+	Hidden   bool     `json:"hidden"`
+}
+
+// Returned when a menu tree would be invalid, the message is safe to show to clients
+type MenuTreeError struct {
+	Message string
+}
+
+func (e *MenuTreeError) Error() string {
+	return e.Message
+}
+
+// Seed default menus from the embedded JSON files for roles without any menu
+func createDefaultMenus() error {
+	for _, role := range menuSeedRoles {
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM menus WHERE role = ?", role).Scan(&count)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+
+		data, err := fs.ReadFile(embeddedFiles, menuSeedDir+"/menu-"+role+".json")
+		if err != nil {
+			// The bundle may have been built without menu data, nothing to seed
+			log.Warnf("No default menu found for role %s: %v", role, err)
+			continue
+		}
+
+		var seed MenuTreeRequest
+		if err := json.Unmarshal(data, &seed); err != nil {
+			return err
+		}
+
+		if err := replaceMenuTree(role, seed.Menu); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace the whole menu tree of a role in a single transaction
+func replaceMenuTree(role string, nodes []MenuNode) error {
+	if err := validateMenuNodes(nodes); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM menus WHERE role = ?", role); err != nil {
+		return err
+	}
+	if err := insertMenuNodes(tx, role, sql.NullInt64{}, nodes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertMenuNodes(tx *sql.Tx, role string, parentID sql.NullInt64, nodes []MenuNode) error {
+	for position, node := range nodes {
+		menu := menuFromNode(node)
+		menu.Role = role
+		menu.ParentID = parentID
+		menu.Position = position
+
+		id, err := insertMenu(tx, &menu)
+		if err != nil {
+			return err
+		}
+
+		if len(node.Children) > 0 {
+			if err := insertMenuNodes(tx, role, sql.NullInt64{Int64: id, Valid: true}, node.Children); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func insertMenu(tx *sql.Tx, menu *Menu) (int64, error) {
+	result, err := tx.Exec(`
+		INSERT INTO menus (role, parent_id, position, route, name, type, icon,
+		                   label_color, label_value, badge_color, badge_value, hidden)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		menu.Role, menu.ParentID, menu.Position, menu.Route, menu.Name, menu.Type, menu.Icon,
+		menu.LabelColor, menu.LabelValue, menu.BadgeColor, menu.BadgeValue, menu.Hidden)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Get all menu rows of a role, ordered so siblings come out by position
+func getMenusByRole(role string) ([]Menu, error) {
+	rows, err := db.Query(`
+		SELECT id, role, parent_id, position, route, name, type, icon,
+		       label_color, label_value, badge_color, badge_value, hidden
+		FROM menus
+		WHERE role = ?
+		ORDER BY position, id`, role)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var menus []Menu
+	for rows.Next() {
+		var menu Menu
+		err := rows.Scan(&menu.ID, &menu.Role, &menu.ParentID, &menu.Position,
+			&menu.Route, &menu.Name, &menu.Type, &menu.Icon,
+			&menu.LabelColor, &menu.LabelValue, &menu.BadgeColor, &menu.BadgeValue, &menu.Hidden)
+		if err != nil {
+			return nil, err
+		}
+		menus = append(menus, menu)
+	}
+	return menus, rows.Err()
+}
+
+// Create a single menu item, placing it among its siblings
+func createMenuItem(role string, req MenuItemRequest) (int, error) {
+	menus, err := getMenusByRole(role)
+	if err != nil {
+		return 0, err
+	}
+
+	menu := menuFromRequest(req)
+	menu.Role = role
+	menus = append(menus, menu)
+	position := len(menus) // Clamped to the end of the siblings
+	if req.Position != nil {
+		position = *req.Position
+	}
+	layout := arrangeMenus(menus, len(menus)-1, position)
+
+	if err := validateMenus(layout); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	created := layout[len(layout)-1]
+	id, err := insertMenu(tx, &created)
+	if err != nil {
+		return 0, err
+	}
+	if err := saveMenuLayout(tx, menus[:len(menus)-1], layout[:len(layout)-1]); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+// Update a single menu item, moving it if its parent or position changed
+func updateMenuItem(role string, id int, req MenuItemRequest) error {
+	menus, err := getMenusByRole(role)
+	if err != nil {
+		return err
+	}
+
+	index := findMenu(menus, id)
+	if index < 0 {
+		return sql.ErrNoRows
+	}
+
+	menu := menuFromRequest(req)
+	menu.ID = id
+	menu.Role = role
+	position := menus[index].Position
+	if (req.ParentID == nil && menus[index].ParentID.Valid) ||
+		(req.ParentID != nil && int64(*req.ParentID) != menus[index].ParentID.Int64) {
+		position = len(menus) // Moved to another parent, append by default
+	}
+	if req.Position != nil {
+		position = *req.Position
+	}
+
+	updated := append([]Menu{}, menus...)
+	updated[index] = menu
+	layout := arrangeMenus(updated, index, position)
+
+	if err := validateMenus(layout); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		UPDATE menus
+		SET route = ?, name = ?, type = ?, icon = ?, label_color = ?, label_value = ?,
+		    badge_color = ?, badge_value = ?, hidden = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?`,
+		menu.Route, menu.Name, menu.Type, menu.Icon, menu.LabelColor, menu.LabelValue,
+		menu.BadgeColor, menu.BadgeValue, menu.Hidden, id)
+	if err != nil {
+		return err
+	}
+	if err := saveMenuLayout(tx, menus, layout); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Delete a menu item together with all of its descendants
+func deleteMenuItem(role string, id int) error {
+	menus, err := getMenusByRole(role)
+	if err != nil {
+		return err
+	}
+
+	if findMenu(menus, id) < 0 {
+		return sql.ErrNoRows
+	}
+
+	// Collect the item and its descendants
+	deleted := map[int]bool{id: true}
+	for changed := true; changed; {
+		changed = false
+		for _, menu := range menus {
+			if !deleted[menu.ID] && menu.ParentID.Valid && deleted[int(menu.ParentID.Int64)] {
+				deleted[menu.ID] = true
+				changed = true
+			}
+		}
+	}
+
+	var remaining []Menu
+	for _, menu := range menus {
+		if !deleted[menu.ID] {
+			remaining = append(remaining, menu)
+		}
+	}
+	layout := arrangeMenus(remaining, -1, 0)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for menuID := range deleted {
+		if _, err := tx.Exec("DELETE FROM menus WHERE id = ?", menuID); err != nil {
+			return err
+		}
+	}
+	if err := saveMenuLayout(tx, remaining, layout); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Write parent and position changes between two layouts of the same menu rows
+func saveMenuLayout(tx *sql.Tx, before, after []Menu) error {
+	for i := range after {
+		if before[i].ParentID == after[i].ParentID && before[i].Position == after[i].Position {
+			continue
+		}
+		_, err := tx.Exec(`
+			UPDATE menus SET parent_id = ?, position = ?, updated_at = CURRENT_TIMESTAMP
+			WHERE id = ?`, after[i].ParentID, after[i].Position, after[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Renumber sibling positions from 0, placing menus[pinned] at the given
+// position among its siblings. Pass a negative pinned index to only renumber.
+func arrangeMenus(menus []Menu, pinned int, position int) []Menu {
+	layout := append([]Menu{}, menus...)
+
+	groups := map[int64][]int{}
+	for i := range layout {
+		if i != pinned {
+			groups[menuParent(layout[i])] = append(groups[menuParent(layout[i])], i)
+		}
+	}
+	for parent, group := range groups {
+		sort.SliceStable(group, func(a, b int) bool {
+			return layout[group[a]].Position < layout[group[b]].Position
+		})
+		groups[parent] = group
+	}
+
+	if pinned >= 0 {
+		parent := menuParent(layout[pinned])
+		group := groups[parent]
+		position = max(0, min(position, len(group)))
+		group = append(group[:position], append([]int{pinned}, group[position:]...)...)
+		groups[parent] = group
+	}
+
+	for _, group := range groups {
+		for position, i := range group {
+			layout[i].Position = position
+		}
+	}
+	return layout
+}
+
+// Validate a flat menu layout: parents must exist and be "sub" items, no
+// cycles, and no two items may resolve to the same route
+func validateMenus(menus []Menu) error {
+	byID := map[int]*Menu{}
+	for i := range menus {
+		if menus[i].ID != 0 {
+			byID[menus[i].ID] = &menus[i]
+		}
+	}
+
+	paths := map[string]bool{}
+	for i := range menus {
+		menu := &menus[i]
+		if err := validateMenuFields(menu.Route, menu.Name, menu.Type); err != nil {
+			return err
+		}
+
+		// Walk up to the root, which also detects cycles
+		segments := []string{menu.Route}
+		visited := map[int]bool{menu.ID: true}
+		for current := menu; current.ParentID.Valid; {
+			parentID := int(current.ParentID.Int64)
+			parent, ok := byID[parentID]
+			if !ok {
+				return &MenuTreeError{Message: fmt.Sprintf("Parent menu item %d not found", parentID)}
+			}
+			if visited[parentID] {
+				return &MenuTreeError{Message: fmt.Sprintf("Menu item '%s' cannot be nested inside its own children", parent.Route)}
+			}
+			if parent.Type != "sub" {
+				return &MenuTreeError{Message: fmt.Sprintf("Menu item '%s' must be of type 'sub' to have children", parent.Route)}
+			}
+			visited[parentID] = true
+			segments = append([]string{parent.Route}, segments...)
+			current = parent
+		}
+
+		path := strings.Join(segments, "/")
+		if paths[path] {
+			return &MenuTreeError{Message: fmt.Sprintf("Duplicate menu route '%s'", path)}
+		}
+		paths[path] = true
+	}
+	return nil
+}
+
+// Validate a nested menu tree as submitted by admins or read from seed files
+func validateMenuNodes(nodes []MenuNode) error {
+	var menus []Menu
+	var flatten func(parentID int, nodes []MenuNode)
+	flatten = func(parentID int, nodes []MenuNode) {
+		for _, node := range nodes {
+			menu := menuFromNode(node)
+			menu.ID = len(menus) + 1
+			if parentID != 0 {
+				menu.ParentID = sql.NullInt64{Int64: int64(parentID), Valid: true}
+			}
+			menus = append(menus, menu)
+			flatten(menu.ID, node.Children)
+		}
+	}
+	flatten(0, nodes)
+	return validateMenus(menus)
+}
+
+func validateMenuFields(route, name, menuType string) error {
+	if route == "" || name == "" {
+		return &MenuTreeError{Message: "Menu route and name are required"}
+	}
+	if !menuTypes[menuType] {
+		return &MenuTreeError{Message: "Menu type must be 'link', 'sub', 'extLink' or 'extTabLink'"}
+	}
+	return nil
+}
+
+func findMenu(menus []Menu, id int) int {
+	for i := range menus {
+		if menus[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Parent id of a menu, 0 for top level items since ids start at 1
+func menuParent(menu Menu) int64 {
+	if menu.ParentID.Valid {
+		return menu.ParentID.Int64
+	}
+	return 0
+}
+
+func menuFromNode(node MenuNode) Menu {
+	menu := Menu{
+		Route:  node.Route,
+		Name:   node.Name,
+		Type:   node.Type,
+		Icon:   node.Icon,
+		Hidden: node.Hidden,
+	}
+	if node.Label != nil {
+		menu.LabelColor, menu.LabelValue = node.Label.Color, node.Label.Value
+	}
+	if node.Badge != nil {
+		menu.BadgeColor, menu.BadgeValue = node.Badge.Color, node.Badge.Value
+	}
+	return menu
+}
+
+func menuFromRequest(req MenuItemRequest) Menu {
+	menu := menuFromNode(MenuNode{
+		Route:  req.Route,
+		Name:   req.Name,
+		Type:   req.Type,
+		Icon:   req.Icon,
+		Label:  req.Label,
+		Badge:  req.Badge,
+		Hidden: req.Hidden,
+	})
+	if req.ParentID != nil {
+		menu.ParentID = sql.NullInt64{Int64: int64(*req.ParentID), Valid: true}
+	}
+	return menu
+}
+
+func menuTags(menu Menu) (label *MenuTag, badge *MenuTag) {
+	if menu.LabelValue != "" {
+		label = &MenuTag{Color: menu.LabelColor, Value: menu.LabelValue}
+	}
+	if menu.BadgeValue != "" {
+		badge = &MenuTag{Color: menu.BadgeColor, Value: menu.BadgeValue}
+	}
+	return label, badge
+}
+
+func groupMenusByParent(menus []Menu) map[int64][]Menu {
+	children := map[int64][]Menu{}
+	for _, menu := range menus {
+		children[menuParent(menu)] = append(children[menuParent(menu)], menu)
+	}
+	for _, group := range children {
+		sort.SliceStable(group, func(a, b int) bool {
+			return group[a].Position < group[b].Position
+		})
+	}
+	return children
+}
+
+// Build the nested menu tree the frontend expects, leaving out hidden items
+func buildMenuTree(menus []Menu) []MenuItem {
+	children := groupMenusByParent(menus)
+
+	var build func(parent int64) []MenuItem
+	build = func(parent int64) []MenuItem {
+		items := []MenuItem{}
+		for _, menu := range children[parent] {
+			if menu.Hidden {
+				continue
+			}
+			item := MenuItem{
+				Route:    menu.Route,
+				Name:     menu.Name,
+				Type:     menu.Type,
+				Icon:     menu.Icon,
+				Children: build(int64(menu.ID)),
+			}
+			item.Label, item.Badge = menuTags(menu)
+			items = append(items, item)
+		}
+		return items
+	}
+	return build(0)
+}
+
+// Build the nested menu tree for admins, including hidden items
+func buildMenuNodes(menus []Menu) []MenuNode {
+	children := groupMenusByParent(menus)
+
+	var build func(parent int64) []MenuNode
+	build = func(parent int64) []MenuNode {
+		nodes := []MenuNode{}
+		for _, menu := range children[parent] {
+			node := MenuNode{
+				ID:       menu.ID,
+				Position: menu.Position,
+				Route:    menu.Route,
+				Name:     menu.Name,
+				Type:     menu.Type,
+				Icon:     menu.Icon,
+				Hidden:   menu.Hidden,
+				Children: build(int64(menu.ID)),
+			}
+			if menu.ParentID.Valid {
+				parentID := int(menu.ParentID.Int64)
+				node.ParentID = &parentID
+			}
+			node.Label, node.Badge = menuTags(menu)
+			nodes = append(nodes, node)
+		}
+		return nodes
+	}
+	return build(0)
+}
+
+// Respond to a failed menu change, validation errors are reported as bad requests
+func menuErrorResponse(c *fiber.Ctx, err error, message string) error {
+	var treeErr *MenuTreeError
+	if errors.As(err, &treeErr) {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: treeErr.Message,
+		})
+	}
+	if err == sql.ErrNoRows {
+		return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+			Error: "Menu item not found",
+		})
+	}
+	log.Warnf("%s: %v", message, err)
+	return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+		Error: message,
+	})
+}
+
+// Only known roles have menus
+func validMenuRole(role string) bool {
+	return role == "admin" || role == "user"
+}
+
+func invalidMenuRoleResponse(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+		Error: "Role must be 'admin' or 'user'",
+	})
+}
+
+func menuTreeResponse(c *fiber.Ctx, role string, status int) error {
+	menus, err := getMenusByRole(role)
+	if err != nil {
+		return menuErrorResponse(c, err, "Failed to fetch menu")
+	}
+
+	return c.Status(status).JSON(MenuTreeResponse{
+		Role: role,
+		Menu: buildMenuNodes(menus),
+	})
+}
+
+// GET /user/menu
+// Get menu of the current user
+// @Summary		Get user menu
+// @Description	Get the navigation menu for the role of the current user
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Success		200				{object}	MenuResponse
+// @Failure		500				{object}	ErrorResponse	"Failed to fetch menu"
+// @Router			/user/menu [GET]
+func menuHandler(c *fiber.Ctx) error {
+	// The role always comes from the token, the ?role= query is ignored
+	role := c.Locals("role").(string)
+
+	menus, err := getMenusByRole(role)
+	if err != nil {
+		log.Warnf("Failed to get menu for role %s: %v", role, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch menu",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(MenuResponse{
+		Menu: buildMenuTree(menus),
+	})
+}
+
+// GET /admin/menus/:role
+// Get menu tree of a role (admin only)
+// @Summary		Get menu tree
+// @Description	Get the full menu tree of a role, including hidden items (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			role	path		string	true	"Role"
+// @Success		200		{object}	MenuTreeResponse
+// @Failure		400		{object}	ErrorResponse	"Invalid role"
+// @Failure		500		{object}	ErrorResponse	"Failed to fetch menu"
+// @Router			/admin/menus/{role} [GET]
+func getMenuTreeHandler(c *fiber.Ctx) error {
+	role := c.Params("role")
+	if !validMenuRole(role) {
+		return invalidMenuRoleResponse(c)
+	}
+
+	return menuTreeResponse(c, role, fiber.StatusOK)
+}
+
+// PUT /admin/menus/:role
+// Replace menu tree of a role (admin only)
+// @Summary		Replace menu tree
+// @Description	Replace the whole menu tree of a role, item ids are ignored (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			role				path		string			true	"Role"
+// @Param			menuTreeRequest		body		MenuTreeRequest	true	"Menu tree"
+// @Success		200					{object}	MenuTreeResponse
+// @Failure		400					{object}	ErrorResponse	"Invalid role, request body or menu tree"
+// @Failure		500					{object}	ErrorResponse	"Failed to save menu"
+// @Router			/admin/menus/{role} [PUT]
+func replaceMenuTreeHandler(c *fiber.Ctx) error {
+	role := c.Params("role")
+	if !validMenuRole(role) {
+		return invalidMenuRoleResponse(c)
+	}
+
+	var req MenuTreeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if err := replaceMenuTree(role, req.Menu); err != nil {
+		return menuErrorResponse(c, err, "Failed to save menu")
+	}
+
+	return menuTreeResponse(c, role, fiber.StatusOK)
+}
+
+// POST /admin/menus/:role/items
+// Create menu item (admin only)
+// @Summary		Create menu item
+// @Description	Add a menu item to the menu of a role (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			role				path		string			true	"Role"
+// @Param			menuItemRequest		body		MenuItemRequest	true	"Menu item"
+// @Success		201					{object}	MenuTreeResponse
+// @Failure		400					{object}	ErrorResponse	"Invalid role, request body or menu tree"
+// @Failure		500					{object}	ErrorResponse	"Failed to create menu item"
+// @Router			/admin/menus/{role}/items [POST]
+func createMenuItemHandler(c *fiber.Ctx) error {
+	role := c.Params("role")
+	if !validMenuRole(role) {
+		return invalidMenuRoleResponse(c)
+	}
+
+	var req MenuItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if _, err := createMenuItem(role, req); err != nil {
+		return menuErrorResponse(c, err, "Failed to create menu item")
+	}
+
+	return menuTreeResponse(c, role, fiber.StatusCreated)
+}
+
+// PUT /admin/menus/:role/items/:id
+// Update menu item (admin only)
+// @Summary		Update menu item
+// @Description	Update, move or reorder a menu item of a role (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			role				path		string			true	"Role"
+// @Param			id					path		int				true	"Menu item ID"
+// @Param			menuItemRequest		body		MenuItemRequest	true	"Menu item"
+// @Success		200					{object}	MenuTreeResponse
+// @Failure		400					{object}	ErrorResponse	"Invalid role, menu item ID, request body or menu tree"
+// @Failure		404					{object}	ErrorResponse	"Menu item not found"
+// @Failure		500					{object}	ErrorResponse	"Failed to update menu item"
+// @Router			/admin/menus/{role}/items/{id} [PUT]
+func updateMenuItemHandler(c *fiber.Ctx) error {
+	role := c.Params("role")
+	if !validMenuRole(role) {
+		return invalidMenuRoleResponse(c)
+	}
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid menu item ID",
+		})
+	}
+
+	var req MenuItemRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if err := updateMenuItem(role, id, req); err != nil {
+		return menuErrorResponse(c, err, "Failed to update menu item")
+	}
+
+	return menuTreeResponse(c, role, fiber.StatusOK)
+}
+
+// DELETE /admin/menus/:role/items/:id
+// Delete menu item (admin only)
+// @Summary		Delete menu item
+// @Description	Delete a menu item and all of its children (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			role	path		string	true	"Role"
+// @Param			id		path		int		true	"Menu item ID"
+// @Success		200		{object}	MenuTreeResponse
+// @Failure		400		{object}	ErrorResponse	"Invalid role or menu item ID"
+// @Failure		404		{object}	ErrorResponse	"Menu item not found"
+// @Failure		500		{object}	ErrorResponse	"Failed to delete menu item"
+// @Router			/admin/menus/{role}/items/{id} [DELETE]
+func deleteMenuItemHandler(c *fiber.Ctx) error {
+	role := c.Params("role")
+	if !validMenuRole(role) {
+		return invalidMenuRoleResponse(c)
+	}
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid menu item ID",
+		})
+	}
+
+	if err := deleteMenuItem(role, id); err != nil {
+		return menuErrorResponse(c, err, "Failed to delete menu item")
+	}
+
+	return menuTreeResponse(c, role, fiber.StatusOK)
+}
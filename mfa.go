@@ -0,0 +1,700 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer      = "webadmin" // Issuer shown in authenticator apps
+	totpPeriod      = 30         // Seconds a code is valid
+	totpDigits      = 6          // Digits of a code
+	totpSkew        = 1          // Periods before and after the current one that are accepted
+	recoveryCodes   = 10         // Recovery codes generated for a user
+	maxMFAAttempts  = 5          // Failed codes before a login challenge is revoked
+	qrCodeImageSize = 256        // Width and height of the enrollment QR code
+)
+
+// Characters of recovery codes, without easily confused ones
+const recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// Returned when enrolling a user who already has TOTP enabled
+var errTOTPAlreadyEnabled = errors.New("totp already enabled")
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type MFAStatusResponse struct {
+	TOTPEnabled            bool `json:"totp_enabled"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+type TOTPEnrollmentResponse struct {
+	Secret     string `json:"secret"`      // Base32 secret for manual entry
+	OTPAuthURI string `json:"otpauth_uri"` // URI encoded in the QR code
+	QRCode     string `json:"qr_code"`     // PNG data URI of the QR code
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type PasswordConfirmRequest struct {
+	Password string `json:"password"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"` // Shown only once, each code works once
+}
+
+type MFAVerifyRequest struct {
+	Code         string `json:"code,omitempty"`          // Code of the authenticator app
+	RecoveryCode string `json:"recovery_code,omitempty"` // Or one of the recovery codes
+	RememberMe   bool   `json:"rememberMe"`
+}
+
+// Compute the TOTP code of a time step (RFC 6238 with HMAC-SHA1)
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// Find the time step a code is valid for, ignoring steps up to lastStep so
+// each code can only be used once
+func matchTOTPCode(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.ReplaceAll(code, " ", "")
+
+	current := time.Now().Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Build the otpauth URI authenticator apps enroll from
+func totpURI(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totpIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Check whether a user confirmed TOTP enrollment
+func isTOTPEnabled(userID int) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM user_totp
+		WHERE user_id = ? AND confirmed_at IS NOT NULL`, userID).Scan(&count)
+	return count > 0, err
+}
+
+// Start TOTP enrollment with a new secret, replacing an unconfirmed one
+func beginTOTPEnrollment(userID int) (string, error) {
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		return "", err
+	}
+	if enabled {
+		return "", errTOTPAlreadyEnabled
+	}
+
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	secret := base32NoPadding.EncodeToString(key)
+
+	_, err = db.Exec(`
+		INSERT OR REPLACE INTO user_totp (user_id, secret)
+		VALUES (?, ?)`, userID, secret)
+	return secret, err
+}
+
+// Confirm TOTP enrollment with a code from the authenticator app
+func confirmTOTP(userID int, code string) error {
+	var secret string
+	err := db.QueryRow(`
+		SELECT secret FROM user_totp
+		WHERE user_id = ? AND confirmed_at IS NULL`, userID).Scan(&secret)
+	if err != nil {
+		return err
+	}
+
+	step, ok := matchTOTPCode(secret, code, 0)
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	_, err = db.Exec(`
+		UPDATE user_totp SET confirmed_at = CURRENT_TIMESTAMP, last_used_step = ?
+		WHERE user_id = ?`, step, userID)
+	return err
+}
+
+// Check a TOTP code of a user, each code is accepted only once
+func verifyTOTP(userID int, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := db.QueryRow(`
+		SELECT secret, last_used_step FROM user_totp
+		WHERE user_id = ? AND confirmed_at IS NOT NULL`, userID).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	step, ok := matchTOTPCode(secret, code, lastStep)
+	if !ok {
+		return false, nil
+	}
+
+	// Guard against the same code being used concurrently
+	result, err := db.Exec(`
+		UPDATE user_totp SET last_used_step = ?
+		WHERE user_id = ? AND last_used_step < ?`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Remove the second factor and recovery codes of a user
+func disableTOTP(userID int) error {
+	if _, err := db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	_, err := db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	return err
+}
+
+// Normalize a recovery code as typed by a user
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// Generate new recovery codes for a user, replacing the old ones
+func createRecoveryCodes(userID int) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodes)
+	for range recoveryCodes {
+		code, err := randomString(recoveryCodeAlphabet, 10)
+		if err != nil {
+			return nil, err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash)
+			VALUES (?, ?)`, userID, hashToken(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+	return codes, tx.Commit()
+}
+
+// Use up a recovery code of a user
+func useRecoveryCode(userID int, code string) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL`,
+		userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Count the recovery codes a user has left
+func countRecoveryCodes(userID int) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM recovery_codes
+		WHERE user_id = ? AND used_at IS NULL`, userID).Scan(&count)
+	return count, err
+}
+
+// Check whether the policy requires two-factor authentication for a role
+func mfaRequiredForRole(role string) bool {
+	return slices.Contains(settings.MFARequiredRoles, "*") || slices.Contains(settings.MFARequiredRoles, role)
+}
+
+// Get the time a user has to enable two-factor authentication by, zero if the
+// policy does not require it or the user has enabled it. The grace period
+// starts when the user gets a role requiring it, see updateMFAGracePeriod.
+func mfaEnrollmentDeadline(user *User) (time.Time, error) {
+	if !mfaRequiredForRole(user.Role) {
+		return time.Time{}, nil
+	}
+	enabled, err := isTOTPEnabled(user.ID)
+	if err != nil || enabled {
+		return time.Time{}, err
+	}
+
+	var deadline sql.NullTime
+	err = db.QueryRow("SELECT mfa_grace_until FROM users WHERE id = ?", user.ID).Scan(&deadline)
+	return deadline.Time, err
+}
+
+// Start the grace period of a user given a role that requires two-factor
+// authentication, or end it if the role does not require it
+func updateMFAGracePeriod(userID int, role string) error {
+	if !mfaRequiredForRole(role) {
+		_, err := db.Exec("UPDATE users SET mfa_grace_until = NULL WHERE id = ?", userID)
+		return err
+	}
+	_, err := db.Exec(`
+		UPDATE users SET mfa_grace_until = ?
+		WHERE id = ? AND mfa_grace_until IS NULL`, time.Now().Add(settings.MFAGracePeriod), userID)
+	return err
+}
+
+// Start or end the grace periods of all users at startup, as the roles
+// requiring two-factor authentication may have changed
+func updateMFAGracePeriods() error {
+	required := "0"
+	args := []interface{}{}
+	if slices.Contains(settings.MFARequiredRoles, "*") {
+		required = "1"
+	} else if len(settings.MFARequiredRoles) > 0 {
+		required = "role IN (?" + strings.Repeat(", ?", len(settings.MFARequiredRoles)-1) + ")"
+		for _, role := range settings.MFARequiredRoles {
+			args = append(args, role)
+		}
+	}
+	_, err := db.Exec(`
+		UPDATE users SET mfa_grace_until = CASE WHEN `+required+` THEN COALESCE(mfa_grace_until, ?) END`,
+		append(args, time.Now().Add(settings.MFAGracePeriod))...)
+	return err
+}
+
+// Count a failed second factor attempt and return the number of failures in a row
+func recordMFAFailure(userID int) (int, error) {
+	var attempts int
+	err := db.QueryRow(`
+		UPDATE user_totp SET failed_attempts = failed_attempts + 1
+		WHERE user_id = ?
+		RETURNING failed_attempts`, userID).Scan(&attempts)
+	return attempts, err
+}
+
+func resetMFAFailures(userID int) error {
+	_, err := db.Exec("UPDATE user_totp SET failed_attempts = 0 WHERE user_id = ?", userID)
+	return err
+}
+
+// GET /user/mfa
+// Get two-factor authentication status of the current user
+// @Summary		Get 2FA status
+// @Description	Get whether TOTP is enabled for the current user and how many recovery codes are left
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Success		200	{object}	MFAStatusResponse
+// @Failure		500	{object}	ErrorResponse	"Failed to fetch two-factor status"
+// @Router			/user/mfa [GET]
+func getMFAStatusHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch two-factor status",
+		})
+	}
+	remaining, err := countRecoveryCodes(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch two-factor status",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(MFAStatusResponse{
+		TOTPEnabled:            enabled,
+		RecoveryCodesRemaining: remaining,
+	})
+}
+
+// POST /user/mfa/totp
+// Start TOTP enrollment of the current user
+// @Summary		Enroll TOTP
+// @Description	Generate a TOTP secret for the current user. Two-factor authentication is enabled once a code is confirmed at /user/mfa/totp/confirm.
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Success		200	{object}	TOTPEnrollmentResponse
+// @Failure		409	{object}	ErrorResponse	"TOTP is already enabled"
+// @Failure		500	{object}	ErrorResponse	"Failed to enroll TOTP"
+// @Router			/user/mfa/totp [POST]
+func enrollTOTPHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	username := c.Locals("username").(string)
+
+	secret, err := beginTOTPEnrollment(userID)
+	if err != nil {
+		if err == errTOTPAlreadyEnabled {
+			return c.Status(fiber.StatusConflict).JSON(ErrorResponse{
+				Error: "TOTP is already enabled",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to enroll TOTP",
+		})
+	}
+
+	uri := totpURI(username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeImageSize)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to enroll TOTP",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(TOTPEnrollmentResponse{
+		Secret:     secret,
+		OTPAuthURI: uri,
+		QRCode:     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// POST /user/mfa/totp/confirm
+// Confirm TOTP enrollment of the current user
+// @Summary		Confirm TOTP
+// @Description	Enable two-factor authentication with a code of the enrolled authenticator app. Returns recovery codes, which are only shown once. An "mfa_enrollment" token is revoked afterwards, the user has to log in again.
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			totpCodeRequest	body		TOTPCodeRequest	true	"Code of the authenticator app"
+// @Success		200				{object}	RecoveryCodesResponse
+// @Failure		400				{object}	ErrorResponse	"Invalid request body, invalid code or no pending enrollment"
+// @Failure		500				{object}	ErrorResponse	"Failed to confirm TOTP"
+// @Router			/user/mfa/totp/confirm [POST]
+func confirmTOTPHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req TOTPCodeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if err := confirmTOTP(userID, req.Code); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+				Error: "Invalid code or no pending enrollment",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to confirm TOTP",
+		})
+	}
+
+	codes, err := createRecoveryCodes(userID)
+	if err != nil {
+		log.Warnf("Failed to create recovery codes of user %d: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to create recovery codes",
+		})
+	}
+	logRequestSecurityEvent(c, "mfa_enabled", userID, "enabled TOTP")
+
+	// An enrollment token has served its purpose, the user logs in again with the new factor
+	if claims, ok := c.Locals("claims").(*Claims); ok && claims.Scope == scopeMFAEnrollment {
+		if err := revokeAccessToken(claims); err != nil {
+			log.Warnf("Failed to revoke token of user %d: %v", userID, err)
+		}
+	}
+
+	return c.Status(fiber.StatusOK).JSON(RecoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+// DELETE /user/mfa/totp
+// Disable TOTP of the current user
+// @Summary		Disable TOTP
+// @Description	Disable two-factor authentication of the current user after confirming the password
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			passwordConfirmRequest	body		PasswordConfirmRequest	true	"Current password"
+// @Success		200						{object}	SuccessResponse	"TOTP disabled message"
+// @Failure		400						{object}	ErrorResponse	"Invalid request body"
+// @Failure		401						{object}	ErrorResponse	"Password is incorrect"
+// @Failure		500						{object}	ErrorResponse	"Failed to disable TOTP"
+// @Router			/user/mfa/totp [DELETE]
+func disableTOTPHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req PasswordConfirmRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if err := verifyUserPassword(userID, req.Password); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(ErrorResponse{
+			Error: "Password is incorrect",
+		})
+	}
+
+	if err := disableTOTP(userID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to disable TOTP",
+		})
+	}
+	logRequestSecurityEvent(c, "mfa_disabled", userID, "disabled TOTP")
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "TOTP disabled successfully",
+	})
+}
+
+// POST /user/mfa/recovery-codes
+// Regenerate recovery codes of the current user
+// @Summary		Regenerate recovery codes
+// @Description	Replace the recovery codes of the current user after confirming the password
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			passwordConfirmRequest	body		PasswordConfirmRequest	true	"Current password"
+// @Success		200						{object}	RecoveryCodesResponse
+// @Failure		400						{object}	ErrorResponse	"Invalid request body or TOTP not enabled"
+// @Failure		401						{object}	ErrorResponse	"Password is incorrect"
+// @Failure		500						{object}	ErrorResponse	"Failed to create recovery codes"
+// @Router			/user/mfa/recovery-codes [POST]
+func regenerateRecoveryCodesHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req PasswordConfirmRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if err := verifyUserPassword(userID, req.Password); err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(ErrorResponse{
+			Error: "Password is incorrect",
+		})
+	}
+
+	enabled, err := isTOTPEnabled(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to create recovery codes",
+		})
+	}
+	if !enabled {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "TOTP is not enabled",
+		})
+	}
+
+	codes, err := createRecoveryCodes(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to create recovery codes",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(RecoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+// POST /auth/mfa/verify
+// Complete login with a second factor godoc
+//
+//	@Summary		Verify second factor
+//	@Description	Complete a login with a TOTP code or a recovery code, using the "mfa_required" challenge token returned by /auth/login as bearer token. Wrong codes count toward the account lockout, and the challenge is revoked after too many of them.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			mfaVerifyRequest	body		MFAVerifyRequest	true	"TOTP code or recovery code"
+//	@Success		200					{object}	Token
+//	@Failure		400					{object}	ErrorResponse	"Invalid request body or missing code"
+//	@Failure		401					{object}	ErrorResponse	"Invalid code"
+//	@Failure		429					{object}	ErrorResponse	"Too many failed login attempts, see the Retry-After header"
+//	@Failure		500					{object}	ErrorResponse	"Internal server error"
+//	@Router			/auth/mfa/verify [POST]
+func verifyMFAHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	claims := c.Locals("claims").(*Claims)
+
+	var req MFAVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Code == "" && req.RecoveryCode == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Code or recovery code is required",
+		})
+	}
+
+	// Wrong codes count toward the account lockout like wrong passwords
+	retryAfter, err := usernameLoginRetryAfter(claims.Username)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+	if retryAfter > 0 {
+		return tooManyLoginAttempts(c, retryAfter)
+	}
+
+	var ok bool
+	if req.Code != "" {
+		ok, err = verifyTOTP(userID, req.Code)
+	} else {
+		ok, err = useRecoveryCode(userID, req.RecoveryCode)
+		if ok {
+			logRequestSecurityEvent(c, "recovery_code_used", userID, "logged in with a recovery code")
+		}
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	if !ok {
+		if err := recordLoginFailure(c, userID, claims.Username); err != nil {
+			log.Warnf("Failed to record failed login: %v", err)
+		}
+		// The count survives new challenges and is only reset by a correct
+		// code, so once there were too many guesses every further wrong code
+		// requires entering the password again
+		attempts, err := recordMFAFailure(userID)
+		if err == nil && attempts >= maxMFAAttempts {
+			revokeAccessToken(claims)
+			logRequestSecurityEvent(c, "mfa_challenge_revoked", userID, fmt.Sprintf("%d wrong codes", attempts))
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid code",
+		})
+	}
+
+	// A challenge completes a single login
+	resetMFAFailures(userID)
+	if err := revokeAccessToken(claims); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Internal server error",
+		})
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil || user.Status != "active" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	return completeLogin(c, user, req.RememberMe, true)
+}
+
+// DELETE /admin/users/:id/mfa
+// Reset two-factor authentication of a user (admin only)
+// @Summary		Reset user 2FA
+// @Description	Remove the second factor, recovery codes and passkeys of a user who lost their device, and sign them out everywhere. If their role requires two-factor authentication, they have to enroll again at their next login (admin only).
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			id	path		int	true	"User ID"
+// @Success		200	{object}	SuccessResponse	"Two-factor authentication reset message"
+// @Failure		400	{object}	ErrorResponse	"Invalid user ID"
+// @Failure		404	{object}	ErrorResponse	"User not found"
+// @Failure		500	{object}	ErrorResponse	"Failed to reset two-factor authentication"
+// @Router			/admin/users/{id}/mfa [DELETE]
+func adminResetMFAHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid user ID",
+		})
+	}
+
+	if _, err := getUserByID(id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset two-factor authentication",
+		})
+	}
+
+	if err := disableTOTP(id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset two-factor authentication",
+		})
+	}
+	if err := deleteUserPasskeys(id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset two-factor authentication",
+		})
+	}
+	if err := revokeUserSessions(id); err != nil {
+		log.Warnf("Failed to revoke sessions of user %d: %v", id, err)
+	}
+	logRequestSecurityEvent(c, "mfa_reset", id, fmt.Sprintf("reset by admin %d", c.Locals("userID").(int)))
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Two-factor authentication reset successfully",
+	})
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How long a password reset link stays valid
+const passwordResetTTL = time.Hour
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type AdminResetPasswordRequest struct {
+	Method   string `json:"method"`             // "temporary" or "email"
+	Password string `json:"password,omitempty"` // Temporary password, generated when empty
+}
+
+type AdminResetPasswordResponse struct {
+	Message           string              `json:"message"`
+	TemporaryPassword string              `json:"temporary_password,omitempty"` // Only set when generated
+	Warnings          []PasswordViolation `json:"warnings,omitempty"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// Create a single-use password reset token for a user, replacing older ones
+func createPasswordResetToken(userID int) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = ?", userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES (?, ?, ?)`, userID, hashToken(token), time.Now().Add(passwordResetTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Set a new password with a reset token. All reset tokens and sessions of
+// the user are revoked, so the token cannot be used twice and existing
+// sessions stop working. The token is only used up if the password is set.
+func resetPasswordWithToken(token string, password string) (int, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	userID, err := passwordResetTokenUserID(tx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	// Consume the token first, only one concurrent request can win
+	result, err := tx.Exec(`
+		UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = ? AND used_at IS NULL`, hashToken(token))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, sql.ErrNoRows
+	}
+
+	if err := writeUserPassword(tx, userID, hashedPassword, false); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM password_reset_tokens WHERE user_id = ?", userID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if err := revokeUserSessions(userID); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// Queries of either *sql.DB or *sql.Tx
+type querier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Find the user of an unused and unexpired password reset token,
+// sql.ErrNoRows if there is none
+func passwordResetTokenUserID(q querier, token string) (int, error) {
+	var userID int
+	var expiresAt time.Time
+	var usedAt sql.NullTime
+	err := q.QueryRow(`
+		SELECT user_id, expires_at, used_at
+		FROM password_reset_tokens
+		WHERE token_hash = ?`, hashToken(token)).Scan(&userID, &expiresAt, &usedAt)
+	if err != nil {
+		return 0, err
+	}
+
+	if usedAt.Valid || time.Now().After(expiresAt) {
+		return 0, sql.ErrNoRows
+	}
+	return userID, nil
+}
+
+// Characters of temporary passwords by character class, without easily
+// confused ones
+var temporaryPasswordClasses = []string{
+	"abcdefghjkmnpqrstuvwxyz",
+	"ABCDEFGHJKLMNPQRSTUVWXYZ",
+	"23456789",
+	"!#$%*+-=?@_",
+}
+
+// Attempts to generate a temporary password the policy accepts, before giving up
+const maxTemporaryPasswordAttempts = 10
+
+// Generate a random temporary password for a user that satisfies the password
+// policy, with a character of every class in random positions
+func generateTemporaryPassword(user *User) (string, error) {
+	alphabet := strings.Join(temporaryPasswordClasses, "")
+	length := max(12, settings.PasswordMinLength)
+	for range maxTemporaryPasswordAttempts {
+		b := []byte{}
+		for _, class := range temporaryPasswordClasses {
+			c, err := randomString(class, 1)
+			if err != nil {
+				return "", err
+			}
+			b = append(b, c...)
+		}
+		rest, err := randomString(alphabet, length-len(b))
+		if err != nil {
+			return "", err
+		}
+		b = append(b, rest...)
+
+		// Shuffle, so the class characters are not always first
+		for i := len(b) - 1; i > 0; i-- {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+			if err != nil {
+				return "", err
+			}
+			j := n.Int64()
+			b[i], b[j] = b[j], b[i]
+		}
+
+		// Random passwords rarely violate other rules, like containing the username
+		password := string(b)
+		if len(checkPasswordPolicy(password, user.Username, user.Email)) == 0 {
+			return password, nil
+		}
+	}
+	return "", fmt.Errorf("no temporary password satisfying the password policy after %d attempts", maxTemporaryPasswordAttempts)
+}
+
+// Generate a random string of the given length from the characters of alphabet
+func randomString(alphabet string, length int) (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// Email a password reset link to a user
+func sendPasswordResetEmail(user *User) error {
+	token, err := createPasswordResetToken(user.ID)
+	if err != nil {
+		return err
+	}
+
+	// A GET on the link opens the reset page of the frontend, which posts the
+	// token and the new password back to the same path
+	link := settings.PublicURL + "/auth/reset-password?token=" + url.QueryEscape(token)
+	return sendMail(MailMessage{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"A password reset was requested for your account %s. Open the link below to choose a new password:\n\n%s\n\n"+
+			"The link expires in %d minutes and can only be used once. If you did not request this, you can ignore this email.\n",
+			user.Name, user.Username, link, int(passwordResetTTL.Minutes())),
+	})
+}
+
+// POST /auth/forgot-password
+// Forgot password godoc
+//
+//	@Summary		Forgot password
+//	@Description	Email a password reset link to the user. The response is the same whether or not the username exists.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			forgotPasswordRequest	body		ForgotPasswordRequest	true	"Username"
+//	@Success		200						{object}	SuccessResponse	"Reset email sent message"
+//	@Failure		400						{object}	ErrorResponse	"Invalid request body or missing username"
+//	@Router			/auth/forgot-password [POST]
+func forgotPasswordHandler(c *fiber.Ctx) error {
+	var req ForgotPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if req.Username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Username is required",
+		})
+	}
+
+	// Look up the user and send the mail in the background, so the response
+	// time does not reveal whether the username exists
+	username := req.Username
+	enqueueMailJob(func() {
+		user, err := getUserByUsername(username)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				log.Warnf("Failed to get user by username: %v", err)
+			}
+			return
+		}
+		if err := sendPasswordResetEmail(user); err != nil {
+			log.Warnf("Failed to send password reset email to user %d: %v", user.ID, err)
+		}
+	})
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "If the account exists, a password reset email has been sent",
+	})
+}
+
+// POST /auth/reset-password
+// Reset password godoc
+//
+//	@Summary		Reset password
+//	@Description	Set a new password using a reset token. Signs the user out of all sessions.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			resetPasswordRequest	body		ResetPasswordRequest	true	"Reset token and new password"
+//	@Success		200						{object}	PasswordChangedResponse	"Password reset message"
+//	@Failure		400						{object}	PasswordPolicyErrorResponse	"Invalid request body, missing fields, invalid or expired token, or password violating the policy"
+//	@Failure		500						{object}	ErrorResponse	"Failed to reset password"
+//	@Router			/auth/reset-password [POST]
+func resetPasswordHandler(c *fiber.Ctx) error {
+	var req ResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if req.Token == "" || req.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Token and password are required",
+		})
+	}
+
+	// The user is needed to check the password policy
+	userID, err := passwordResetTokenUserID(db, req.Token)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+				Error: "Invalid or expired token",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset password",
+		})
+	}
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset password",
+		})
+	}
+	violations, err := checkUserPasswordPolicy(user, req.Password)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset password",
+		})
+	}
+	if len(violations) > 0 {
+		return passwordPolicyError(c, violations)
+	}
+	warnings := checkPasswordWarnings(req.Password)
+
+	if _, err := resetPasswordWithToken(req.Token, req.Password); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+				Error: "Invalid or expired token",
+			})
+		}
+		log.Warnf("Failed to reset password: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset password",
+		})
+	}
+
+	logPasswordWarnings(c, user, warnings)
+
+	return c.Status(fiber.StatusOK).JSON(PasswordChangedResponse{
+		Message:  "Password reset successfully",
+		Warnings: warnings,
+	})
+}
+
+// PUT /user/password
+// Change password of the current user
+// @Summary		Change password
+// @Description	Change the password of the current user. Signs out all other sessions. Also accepts the restricted token issued when a password change is required.
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			changePasswordRequest	body		ChangePasswordRequest	true	"Current and new password"
+// @Success		200						{object}	PasswordChangedResponse	"Password changed message"
+// @Failure		400						{object}	PasswordPolicyErrorResponse	"Invalid request body, missing fields or password violating the policy"
+// @Failure		401						{object}	ErrorResponse	"Current password is incorrect"
+// @Failure		500						{object}	ErrorResponse	"Failed to change password"
+// @Router			/user/password [PUT]
+func changePasswordHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req ChangePasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Current password and new password are required",
+		})
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusUnauthorized).JSON(ErrorResponse{
+				Error: "Current password is incorrect",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to change password",
+		})
+	}
+
+	// Only check the new password once the caller proved to be the user, as
+	// the password history tells whether a password was used before
+	if err := verifyUserPassword(userID, req.CurrentPassword); err != nil {
+		if err == sql.ErrNoRows || err == bcrypt.ErrMismatchedHashAndPassword {
+			return c.Status(fiber.StatusUnauthorized).JSON(ErrorResponse{
+				Error: "Current password is incorrect",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to change password",
+		})
+	}
+
+	violations, err := checkUserPasswordPolicy(user, req.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to change password",
+		})
+	}
+	if len(violations) > 0 {
+		return passwordPolicyError(c, violations)
+	}
+	warnings := checkPasswordWarnings(req.NewPassword)
+
+	if err := setUserPassword(userID, req.NewPassword); err != nil {
+		log.Warnf("Failed to change password of user %d: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to change password",
+		})
+	}
+
+	// Sign out every other session of the user
+	sessionID, _ := c.Locals("sessionID").(string)
+	if err := revokeOtherSessions(userID, sessionID); err != nil {
+		log.Warnf("Failed to revoke sessions of user %d: %v", userID, err)
+	}
+
+	// A restricted token has served its purpose
+	if claims, ok := c.Locals("claims").(*Claims); ok && claims.Scope != "" {
+		if err := revokeAccessToken(claims); err != nil {
+			log.Warnf("Failed to revoke token of user %d: %v", userID, err)
+		}
+	}
+
+	logPasswordWarnings(c, user, warnings)
+
+	return c.Status(fiber.StatusOK).JSON(PasswordChangedResponse{
+		Message:  "Password changed successfully",
+		Warnings: warnings,
+	})
+}
+
+// POST /admin/users/:id/reset-password
+// Reset password of a user (admin only)
+// @Summary		Reset user password
+// @Description	Set a temporary password that must be changed on next login, or email a reset link to the user (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			id							path		int							true	"User ID"
+// @Param			adminResetPasswordRequest	body		AdminResetPasswordRequest	true	"Reset method"
+// @Success		200							{object}	AdminResetPasswordResponse
+// @Failure		400							{object}	PasswordPolicyErrorResponse	"Invalid user ID, request body, method or password violating the policy"
+// @Failure		404							{object}	ErrorResponse	"User not found"
+// @Failure		500							{object}	ErrorResponse	"Failed to reset password"
+// @Router			/admin/users/{id}/reset-password [POST]
+func adminResetPasswordHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid user ID",
+		})
+	}
+
+	var req AdminResetPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if req.Method != "temporary" && req.Method != "email" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Method must be 'temporary' or 'email'",
+		})
+	}
+
+	user, err := getUserByID(id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "User not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset password",
+		})
+	}
+
+	if req.Method == "email" {
+		enqueueMailJob(func() {
+			if err := sendPasswordResetEmail(user); err != nil {
+				log.Warnf("Failed to send password reset email to user %d: %v", user.ID, err)
+			}
+		})
+		return c.Status(fiber.StatusOK).JSON(AdminResetPasswordResponse{
+			Message: "Password reset email sent",
+		})
+	}
+
+	response := AdminResetPasswordResponse{
+		Message: "Temporary password set, it must be changed on next login",
+	}
+	password := req.Password
+	if password == "" {
+		if password, err = generateTemporaryPassword(user); err != nil {
+			log.Warnf("Failed to generate temporary password of user %d: %v", user.ID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+				Error: "Failed to reset password",
+			})
+		}
+		response.TemporaryPassword = password
+	} else if violations := checkPasswordPolicy(password, user.Username, user.Email); len(violations) > 0 {
+		return passwordPolicyError(c, violations)
+	}
+	response.Warnings = checkPasswordWarnings(password)
+
+	if err := setTemporaryPassword(user.ID, password); err != nil {
+		log.Warnf("Failed to set temporary password of user %d: %v", user.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to reset password",
+		})
+	}
+	logPasswordWarnings(c, user, response.Warnings)
+
+	// Existing sessions must not outlive the old password
+	if err := revokeUserSessions(user.ID); err != nil {
+		log.Warnf("Failed to revoke sessions of user %d: %v", user.ID, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
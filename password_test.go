@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestGenerateTemporaryPasswordSatisfiesPolicy(t *testing.T) {
+	minLength, minClasses := settings.PasswordMinLength, settings.PasswordMinClasses
+	t.Cleanup(func() {
+		settings.PasswordMinLength, settings.PasswordMinClasses = minLength, minClasses
+	})
+	settings.PasswordMinClasses = 4
+
+	user := &User{Username: "alice", Email: "alice@example.com"}
+	for _, length := range []int{8, 12, 20} {
+		settings.PasswordMinLength = length
+		for range 50 {
+			password, err := generateTemporaryPassword(user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(password) < max(12, length) {
+				t.Errorf("temporary password %q shorter than %d", password, max(12, length))
+			}
+			if violations := checkPasswordPolicy(password, user.Username, user.Email); len(violations) > 0 {
+				t.Errorf("temporary password %q violates the policy: %v", password, violations)
+			}
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Longest password bcrypt can hash, longer ones are rejected by bcrypt
+const maxPasswordBytes = 72
+
+// Parts of usernames and email addresses shorter than this are not searched for
+const minIdentifierLength = 3
+
+// Frequently used passwords, one per line in lower case
+//
+//go:embed common_passwords.txt
+var commonPasswordsList string
+
+var commonPasswords = func() map[string]bool {
+	passwords := map[string]bool{}
+	for _, line := range strings.Split(commonPasswordsList, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			passwords[line] = true
+		}
+	}
+	return passwords
+}()
+
+// A password policy rule a password does not satisfy
+type PasswordViolation struct {
+	Rule    string `json:"rule"` // min_length, max_length, character_classes, contains_username, contains_email, common_password, breached_password or password_reused
+	Message string `json:"message"`
+}
+
+type PasswordPolicyErrorResponse struct {
+	Error      string              `json:"error"`
+	Violations []PasswordViolation `json:"violations"`
+}
+
+// A stored password, with the policy rules it only warns about
+type PasswordChangedResponse struct {
+	Message  string              `json:"message"`
+	Warnings []PasswordViolation `json:"warnings,omitempty"`
+}
+
+// A created user, with the policy rules its password only warns about
+type CreatedUserResponse struct {
+	UserResponse
+	Warnings []PasswordViolation `json:"warnings,omitempty"`
+}
+
+// Count the character classes of a password: lower case, upper case, digits and others
+func passwordCharacterClasses(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	classes := 0
+	for _, present := range []bool{lower, upper, digit, other} {
+		if present {
+			classes++
+		}
+	}
+	return classes
+}
+
+// Check whether a password is a common one, also with digits and symbols
+// appended like "Summer2024!"
+func isCommonPassword(password string) bool {
+	password = strings.ToLower(password)
+	if commonPasswords[password] {
+		return true
+	}
+	base := strings.TrimRightFunc(password, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	return len(base) >= minIdentifierLength && commonPasswords[base]
+}
+
+// Check a new password of a user against the password policy, returning
+// every rule it violates
+func checkPasswordPolicy(password string, username string, email string) []PasswordViolation {
+	violations := []PasswordViolation{}
+	add := func(rule string, message string) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: message})
+	}
+
+	if utf8.RuneCountInString(password) < settings.PasswordMinLength {
+		add("min_length", fmt.Sprintf("Password must be at least %d characters", settings.PasswordMinLength))
+	}
+	if len(password) > maxPasswordBytes {
+		add("max_length", fmt.Sprintf("Password must be at most %d bytes", maxPasswordBytes))
+	}
+	if passwordCharacterClasses(password) < settings.PasswordMinClasses {
+		add("character_classes", fmt.Sprintf("Password must contain at least %d of lower case letters, upper case letters, digits and symbols", settings.PasswordMinClasses))
+	}
+
+	lower := strings.ToLower(password)
+	if username = strings.ToLower(username); len(username) >= minIdentifierLength && strings.Contains(lower, username) {
+		add("contains_username", "Password must not contain the username")
+	}
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if len(local) >= minIdentifierLength && strings.Contains(lower, local) {
+		add("contains_email", "Password must not contain the email address")
+	}
+
+	if isCommonPassword(password) {
+		add("common_password", "Password is too common")
+	}
+
+	if settings.BreachedPasswordAction != "warn" && isBreachedPassword(password) {
+		add("breached_password", "Password appeared in a data breach and must not be used")
+	}
+	return violations
+}
+
+// Check a new password against the policy rules that only warn, so the
+// password is stored anyway
+func checkPasswordWarnings(password string) []PasswordViolation {
+	warnings := []PasswordViolation{}
+	if settings.BreachedPasswordAction == "warn" && isBreachedPassword(password) {
+		warnings = append(warnings, PasswordViolation{
+			Rule:    "breached_password",
+			Message: "Password appeared in a data breach, consider changing it",
+		})
+	}
+	return warnings
+}
+
+// Record the warnings of a password once it is stored for a user
+func logPasswordWarnings(c *fiber.Ctx, user *User, warnings []PasswordViolation) {
+	for _, warning := range warnings {
+		logRequestSecurityEvent(c, warning.Rule, user.ID, "password set for "+user.Username+": "+warning.Message)
+	}
+}
+
+// Check whether a password is in the breached password list, if one is loaded
+func isBreachedPassword(password string) bool {
+	return breachedPasswords != nil && breachedPasswords.Contains(password)
+}
+
+// Check a new password of an existing user against the password policy,
+// including the password history
+func checkUserPasswordPolicy(user *User, password string) ([]PasswordViolation, error) {
+	violations := checkPasswordPolicy(password, user.Username, user.Email)
+	if settings.PasswordHistory > 0 {
+		reused, err := isPasswordReused(user.ID, password)
+		if err != nil {
+			return nil, err
+		}
+		if reused {
+			violations = append(violations, PasswordViolation{
+				Rule:    "password_reused",
+				Message: fmt.Sprintf("Password must differ from the last %d passwords", settings.PasswordHistory),
+			})
+		}
+	}
+	return violations, nil
+}
+
+// Reject a password that violates the policy, listing the violated rules
+func passwordPolicyError(c *fiber.Ctx, violations []PasswordViolation) error {
+	return c.Status(fiber.StatusBadRequest).JSON(PasswordPolicyErrorResponse{
+		Error:      violations[0].Message,
+		Violations: violations,
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Rules of the violations, in order
+func violatedRules(violations []PasswordViolation) []string {
+	rules := []string{}
+	for _, violation := range violations {
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	minLength, minClasses := settings.PasswordMinLength, settings.PasswordMinClasses
+	t.Cleanup(func() {
+		settings.PasswordMinLength, settings.PasswordMinClasses = minLength, minClasses
+	})
+	settings.PasswordMinLength = 10
+	settings.PasswordMinClasses = 3
+
+	tests := []struct {
+		name     string
+		password string
+		username string
+		email    string
+		want     []string
+	}{
+		{"valid", "Correct-Horse-7", "alice", "alice@example.com", []string{}},
+		{"too short", "Sh0rt-pw", "alice", "alice@example.com", []string{"min_length"}},
+		{"exactly the minimum length", "Brisk-Owl9", "alice", "alice@example.com", []string{}},
+		{"minimum length counts characters, not bytes", "Ünïcödé-1", "alice", "alice@example.com", []string{"min_length"}},
+		{"longer than bcrypt hashes", "Aa1-" + strings.Repeat("x", 69), "alice", "alice@example.com", []string{"max_length"}},
+		{"at the bcrypt limit", "Aa1-" + strings.Repeat("x", 68), "alice", "alice@example.com", []string{}},
+		{"two character classes", "onlylower123", "alice", "alice@example.com", []string{"character_classes"}},
+		{"one character class", "abcdefghijkl", "alice", "alice@example.com", []string{"character_classes"}},
+		{"symbols count as a class", "lower-case-99", "alice", "alice@example.com", []string{}},
+		{"contains the username", "My-Alice-Pass-1", "alice", "a.l@example.com", []string{"contains_username"}},
+		{"short usernames are not searched for", "Al-Password-1x", "al", "someone@example.com", []string{}},
+		{"contains the email local part", "Jsmith-Secret-1", "alice", "jsmith@example.com", []string{"contains_email"}},
+		{"email domain is not searched for", "Example-Secret-1", "alice", "alice@example.com", []string{}},
+		{"common password", "Password", "alice", "alice@example.com", []string{"min_length", "character_classes", "common_password"}},
+		{"common password with digits and symbols appended", "Letmein2024!", "alice", "alice@example.com", []string{"common_password"}},
+		{"common word inside a longer password", "Mydragon-Lair-1", "alice", "alice@example.com", []string{}},
+		{"every rule", "alice", "alice", "alice@example.com", []string{"min_length", "character_classes", "contains_username", "contains_email"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := violatedRules(checkPasswordPolicy(tt.password, tt.username, tt.email))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkPasswordPolicy(%q) violates %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreachedPasswordAction(t *testing.T) {
+	list, err := openBreachedPasswordList(writeBreachedPasswordList(t, []string{"Breached-Pass-1"}, func(hash string) string {
+		return hash + "\n"
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, action := breachedPasswords, settings.BreachedPasswordAction
+	t.Cleanup(func() {
+		breachedPasswords, settings.BreachedPasswordAction = previous, action
+	})
+	breachedPasswords = list
+
+	tests := []struct {
+		action       string
+		password     string
+		wantViolated []string
+		wantWarned   []string
+	}{
+		{"reject", "Breached-Pass-1", []string{"breached_password"}, []string{}},
+		{"reject", "Unbreached-Pass-1", []string{}, []string{}},
+		{"warn", "Breached-Pass-1", []string{}, []string{"breached_password"}},
+		{"warn", "Unbreached-Pass-1", []string{}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action+"/"+tt.password, func(t *testing.T) {
+			settings.BreachedPasswordAction = tt.action
+			if got := violatedRules(checkPasswordPolicy(tt.password, "alice", "alice@example.com")); !reflect.DeepEqual(got, tt.wantViolated) {
+				t.Errorf("violations %v, want %v", got, tt.wantViolated)
+			}
+			if got := violatedRules(checkPasswordWarnings(tt.password)); !reflect.DeepEqual(got, tt.wantWarned) {
+				t.Errorf("warnings %v, want %v", got, tt.wantWarned)
+			}
+		})
+	}
+}
+
+func TestCheckUserPasswordPolicyHistory(t *testing.T) {
+	history := settings.PasswordHistory
+	t.Cleanup(func() { settings.PasswordHistory = history })
+	settings.PasswordHistory = 3
+
+	passwords := []string{"First-Secret-1", "Second-Secret-2", "Third-Secret-3", "Fourth-Secret-4"}
+	user, err := createUser(CreateUserRequest{
+		Username: "history",
+		Email:    "history@example.com",
+		Name:     "History",
+		Password: passwords[0],
+		Role:     "user",
+	}, "active")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { deleteUser(user.ID) })
+	for _, password := range passwords[1:] {
+		if err := setUserPassword(user.ID, password); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		history  int
+		password string
+		want     []string
+	}{
+		{"current password", 3, "Fourth-Secret-4", []string{"password_reused"}},
+		{"previous password", 3, "Third-Secret-3", []string{"password_reused"}},
+		{"oldest kept password", 3, "Second-Secret-2", []string{"password_reused"}},
+		{"password dropped from the history", 3, "First-Secret-1", []string{}},
+		{"new password", 3, "Fifth-Secret-5", []string{}},
+		{"only the current password", 1, "Third-Secret-3", []string{}},
+		{"current password without history", 1, "Fourth-Secret-4", []string{"password_reused"}},
+		{"history disabled", 0, "Fourth-Secret-4", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings.PasswordHistory = tt.history
+			violations, err := checkUserPasswordPolicy(user, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := violatedRules(violations); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checkUserPasswordPolicy(%q) violates %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// How often idle buckets are removed from the in-memory store
+const rateLimitPruneInterval = time.Minute
+
+// Token bucket budget: up to Burst requests at once, refilled at Burst
+// tokens per Period. A zero Burst disables the limit.
+type RateLimit struct {
+	Burst  int
+	Period time.Duration
+}
+
+// Parse a limit like "20/1m" or "600/1h", "off" disables the limit
+func parseRateLimit(value string) (RateLimit, error) {
+	if value == "off" || value == "0" {
+		return RateLimit{}, nil
+	}
+	count, period, ok := strings.Cut(value, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q, expected requests/period like 20/1m", value)
+	}
+	burst, err := strconv.Atoi(count)
+	if err != nil || burst < 0 {
+		return RateLimit{}, fmt.Errorf("invalid request count in rate limit %q", value)
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid period in rate limit %q", value)
+	}
+	return RateLimit{Burst: burst, Period: duration}, nil
+}
+
+// Time to refill a single token
+func (l RateLimit) tokenInterval() time.Duration {
+	return l.Period / time.Duration(l.Burst)
+}
+
+// Outcome of taking a token from a bucket
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // Tokens left after this request
+	RetryAfter time.Duration // Time until the next token, when not allowed
+	Reset      time.Duration // Time until the bucket is full again
+}
+
+// Storage of token buckets. The in-memory store only limits a single
+// instance, a shared store makes limits apply across instances.
+type RateLimitStore interface {
+	// Take a token from the bucket of a key, creating a full bucket if needed
+	Take(key string, limit RateLimit) (RateLimitResult, error)
+}
+
+type tokenBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+	Period    time.Duration // Time to refill from empty, for pruning
+}
+
+// Token buckets kept in process memory
+type memoryRateLimitStore struct {
+	sync.Mutex
+	buckets  map[string]*tokenBucket
+	prunedAt time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{buckets: map[string]*tokenBucket{}, prunedAt: time.Now()}
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit RateLimit) (RateLimitResult, error) {
+	now := time.Now()
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Full buckets behave like missing ones, so they can be dropped
+	if now.Sub(s.prunedAt) > rateLimitPruneInterval {
+		for k, bucket := range s.buckets {
+			if now.Sub(bucket.UpdatedAt) > bucket.Period {
+				delete(s.buckets, k)
+			}
+		}
+		s.prunedAt = now
+	}
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{Tokens: float64(limit.Burst), UpdatedAt: now}
+		s.buckets[key] = bucket
+	}
+	bucket.Period = limit.Period
+
+	// Refill for the time since the last request
+	interval := limit.tokenInterval()
+	bucket.Tokens = math.Min(float64(limit.Burst), bucket.Tokens+float64(now.Sub(bucket.UpdatedAt))/float64(interval))
+	bucket.UpdatedAt = now
+
+	result := RateLimitResult{}
+	if bucket.Tokens >= 1 {
+		bucket.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - bucket.Tokens) * float64(interval))
+	}
+	result.Remaining = int(bucket.Tokens)
+	result.Reset = time.Duration((float64(limit.Burst) - bucket.Tokens) * float64(interval))
+	return result, nil
+}
+
+// Buckets of all rate limits, replace with a shared store to limit across instances
+var rateLimitStore RateLimitStore = newMemoryRateLimitStore()
+
+// Check whether an API key is one of the configured keys. Unknown keys must
+// not get their own bucket, or clients could make up keys to avoid limits.
+func isKnownAPIKey(apiKey string) bool {
+	known := false
+	for _, key := range settings.RateLimitAPIKeys {
+		if subtle.ConstantTimeCompare([]byte(apiKey), []byte(key)) == 1 {
+			known = true
+		}
+	}
+	return known
+}
+
+// Identify the client a request is counted for: the user of a valid access
+// token, a configured API key, or the client IP
+func rateLimitKey(c *fiber.Ctx) string {
+	if token, ok := bearerToken(c.Get(fiber.HeaderAuthorization)); ok {
+		if claims, err := validateToken(token); err == nil {
+			return "user:" + strconv.Itoa(claims.UserID)
+		}
+	}
+	if settings.RateLimitAPIKeyHeader != "" {
+		if apiKey := c.Get(settings.RateLimitAPIKeyHeader); apiKey != "" && isKnownAPIKey(apiKey) {
+			return "key:" + hashToken(apiKey)
+		}
+	}
+	return "ip:" + c.IP()
+}
+
+// Pick the budget of a request by its path
+func rateLimitFor(path string) (string, RateLimit) {
+	switch {
+	case strings.HasPrefix(path, "/auth/"):
+		return "auth", settings.RateLimitAuth
+	case strings.HasPrefix(path, "/admin/"):
+		return "admin", settings.RateLimitAdmin
+	default:
+		return "default", settings.RateLimitDefault
+	}
+}
+
+// Seconds for rate limit headers, rounded up so clients never retry too early
+func headerSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Rate limiting middleware with separate budgets for /auth, /admin and
+// everything else, reporting the budget in RateLimit-* headers
+func rateLimitMiddleware(c *fiber.Ctx) error {
+	name, limit := rateLimitFor(c.Path())
+	if limit.Burst == 0 {
+		return c.Next()
+	}
+
+	result, err := rateLimitStore.Take(name+":"+rateLimitKey(c), limit)
+	if err != nil {
+		// Rather serve requests unthrottled than not at all
+		log.Warnf("Failed to check rate limit: %v", err)
+		return c.Next()
+	}
+
+	c.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit.Burst, int(limit.Period.Seconds())))
+	c.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+	c.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Set("RateLimit-Reset", headerSeconds(result.Reset))
+
+	if !result.Allowed {
+		c.Set(fiber.HeaderRetryAfter, headerSeconds(result.RetryAfter))
+		return c.Status(fiber.StatusTooManyRequests).JSON(ErrorResponse{
+			Error: "Too many requests, try again later",
+		})
+	}
+	return c.Next()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Name     string `json:"name,omitempty"` // Defaults to the username
+	Password string `json:"password"`
+}
+
+// Check the email domain against the registration allowlist
+func registrationDomainAllowed(email string) bool {
+	if len(settings.RegistrationDomains) == 0 {
+		return true
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range settings.RegistrationDomains {
+		if domain == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// POST /auth/register
+// Register godoc
+//
+//	@Summary		User registration
+//	@Description	Create a user account, when enabled on the server. Accounts may need admin approval before they can log in.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			registerRequest	body		RegisterRequest	true	"Account details"
+//	@Success		201				{object}	CreatedUserResponse
+//	@Failure		400				{object}	PasswordPolicyErrorResponse	"Invalid request body, missing required fields, email domain not allowed or password violating the policy"
+//	@Failure		403				{object}	ErrorResponse	"Registration is disabled"
+//	@Failure		409				{object}	ErrorResponse	"Username or email already exists"
+//	@Failure		500				{object}	ErrorResponse	"Failed to create user"
+//	@Router			/auth/register [POST]
+func registerHandler(c *fiber.Ctx) error {
+	if !settings.RegistrationEnabled {
+		return c.Status(fiber.StatusForbidden).JSON(ErrorResponse{
+			Error: "Registration is disabled",
+		})
+	}
+
+	var req RegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	// Validate required fields
+	if req.Username == "" || req.Email == "" || req.Password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Username, email, and password are required",
+		})
+	}
+
+	if !strings.Contains(req.Email, "@") || !registrationDomainAllowed(req.Email) {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Email domain is not allowed",
+		})
+	}
+
+	if violations := checkPasswordPolicy(req.Password, req.Username, req.Email); len(violations) > 0 {
+		return passwordPolicyError(c, violations)
+	}
+	warnings := checkPasswordWarnings(req.Password)
+
+	if req.Name == "" {
+		req.Name = req.Username
+	}
+
+	status := "active"
+	if settings.RegistrationApproval {
+		status = "pending"
+	}
+
+	// Self-registered accounts are always plain users
+	user, err := createUser(CreateUserRequest{
+		Username: req.Username,
+		Email:    req.Email,
+		Name:     req.Name,
+		Password: req.Password,
+		Role:     "user",
+	}, status)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return c.Status(fiber.StatusConflict).JSON(ErrorResponse{
+				Error: "Username or email already exists",
+			})
+		}
+		log.Warnf("Failed to register user %s: %v", req.Username, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to create user",
+		})
+	}
+
+	logPasswordWarnings(c, user, warnings)
+
+	// Ask the user to confirm their email address
+	requestEmailVerification(user)
+
+	return c.Status(fiber.StatusCreated).JSON(CreatedUserResponse{
+		UserResponse: newUserResponse(user),
+		Warnings:     warnings,
+	})
+}
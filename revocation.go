@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// How often expired entries are removed from the access token denylist
+const revokedTokenPruneInterval = time.Hour
+
+// Revoke a single access token until it expires
+func revokeAccessToken(claims *Claims) error {
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil
+	}
+	_, err := db.Exec(`
+		INSERT OR IGNORE INTO revoked_tokens (jti, user_id, expires_at)
+		VALUES (?, ?, ?)`, claims.ID, claims.UserID, claims.ExpiresAt.Time)
+	return err
+}
+
+// Revoke every access token issued to a user so far
+func revokeUserTokens(userID int) error {
+	_, err := db.Exec(`
+		UPDATE users SET tokens_valid_after = ?
+		WHERE id = ?`, time.Now().UnixMilli(), userID)
+	return err
+}
+
+// Check whether an access token was revoked, either on its own or because it
+// was issued before its user's tokens were revoked. Tokens of deleted users
+// count as revoked.
+func isTokenRevoked(claims *Claims) (bool, error) {
+	var validAfter int64
+	var denied bool
+	err := db.QueryRow(`
+		SELECT tokens_valid_after, EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		FROM users
+		WHERE id = ?`, claims.ID, claims.UserID).Scan(&validAfter, &denied)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if denied {
+		return true, nil
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.UnixMilli() < validAfter, nil
+}
+
+// Remove denylist entries of tokens that have expired anyway
+func pruneRevokedTokens() (int64, error) {
+	result, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < ?", time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Periodically prune the access token denylist
+func startRevokedTokenPruner() {
+	go func() {
+		ticker := time.NewTicker(revokedTokenPruneInterval)
+		defer ticker.Stop()
+		for {
+			if n, err := pruneRevokedTokens(); err != nil {
+				log.Warnf("Failed to prune revoked tokens: %v", err)
+			} else if n > 0 {
+				log.Debugf("Pruned %d expired revoked tokens", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
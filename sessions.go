@@ -0,0 +1,430 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// Longest user agent stored for a session
+const maxUserAgentLength = 255
+
+// How often expired sessions are deleted
+const sessionPruneInterval = time.Hour
+
+// A login of a user on one device. The session ID is carried in access tokens
+// as "sid" and is the family ID of the refresh tokens issued for the login.
+type Session struct {
+	ID         string
+	UserID     int
+	UserAgent  string
+	IP         string
+	CreatedAt  string
+	LastUsedAt string
+	ExpiresAt  time.Time
+}
+
+type SessionResponse struct {
+	ID         string `json:"id"`
+	UserAgent  string `json:"user_agent"`
+	IP         string `json:"ip"`
+	CreatedAt  string `json:"created_at"`
+	LastUsedAt string `json:"last_used_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current"` // Session of the token making the request
+}
+
+type SessionsListResponse struct {
+	Sessions []SessionResponse `json:"sessions"`
+}
+
+// Latest time a session created now may last, zero when the session lifetime is unlimited
+func sessionDeadline() time.Time {
+	if settings.SessionMaxLifetime == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(settings.SessionMaxLifetime)
+}
+
+// Limit an expiry to a session deadline
+func capExpiry(expiresAt time.Time, deadline time.Time) time.Time {
+	if !deadline.IsZero() && expiresAt.After(deadline) {
+		return deadline
+	}
+	return expiresAt
+}
+
+// Expiry of an access token issued now, which never outlives its session
+func accessTokenExpiry(sessionExpiresAt time.Time) time.Time {
+	return capExpiry(time.Now().Add(settings.AccessTokenTTL), sessionExpiresAt)
+}
+
+// Seconds until a token expires, for Token.ExpiresIn
+func expiresIn(expiresAt time.Time) int {
+	return int(time.Until(expiresAt).Round(time.Second).Seconds())
+}
+
+// Create a session for a login from the requesting client. Refreshes extend
+// the session up to the deadline, if one is given.
+func createSession(c *fiber.Ctx, userID int, expiresAt time.Time, deadline time.Time) (string, error) {
+	id, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	_, err = db.Exec(`
+		INSERT INTO sessions (id, user_id, user_agent, ip, expires_at, max_expires_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, userID, userAgent, c.IP(), expiresAt,
+		sql.NullTime{Time: deadline, Valid: !deadline.IsZero()})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Check that a session has neither been revoked nor expired, recording its use at most once a minute
+func touchSession(id string) (bool, error) {
+	now := time.Now()
+	result, err := db.Exec(`
+		UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND last_used_at < datetime('now', '-1 minute')
+			AND expires_at > ? AND (max_expires_at IS NULL OR max_expires_at > ?)`, id, now, now)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return true, nil
+	}
+
+	var exists int
+	err = db.QueryRow(`
+		SELECT COUNT(*) FROM sessions
+		WHERE id = ? AND expires_at > ? AND (max_expires_at IS NULL OR max_expires_at > ?)`, id, now, now).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists > 0, nil
+}
+
+// Extend a session when its refresh token is rotated
+func extendSession(id string, expiresAt time.Time) error {
+	_, err := db.Exec(`
+		UPDATE sessions SET last_used_at = CURRENT_TIMESTAMP, expires_at = ?
+		WHERE id = ?`, expiresAt, id)
+	return err
+}
+
+// Delete expired sessions together with expired refresh tokens
+func pruneSessions() (int64, error) {
+	now := time.Now()
+	result, err := db.Exec(`
+		DELETE FROM sessions
+		WHERE expires_at < ? OR max_expires_at < ?`, now, now)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := db.Exec("DELETE FROM refresh_tokens WHERE expires_at < ?", now); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Periodically prune expired sessions
+func startSessionPruner() {
+	go func() {
+		ticker := time.NewTicker(sessionPruneInterval)
+		defer ticker.Stop()
+		for {
+			if n, err := pruneSessions(); err != nil {
+				log.Warnf("Failed to prune sessions: %v", err)
+			} else if n > 0 {
+				log.Debugf("Pruned %d expired sessions", n)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+// Get the sessions of a user that have not expired yet
+func getUserSessions(userID int) ([]Session, error) {
+	now := time.Now()
+	rows, err := db.Query(`
+		SELECT id, user_id, user_agent, ip, created_at, last_used_at, expires_at
+		FROM sessions
+		WHERE user_id = ? AND expires_at > ? AND (max_expires_at IS NULL OR max_expires_at > ?)
+		ORDER BY last_used_at DESC`, userID, now, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP,
+			&session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// Revoke a session of a user together with its refresh tokens
+func revokeSession(userID int, id string) error {
+	result, err := db.Exec("DELETE FROM sessions WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = db.Exec("DELETE FROM refresh_tokens WHERE family_id = ?", id)
+	return err
+}
+
+// Revoke the session a refresh token belongs to
+func revokeSessionByRefreshToken(token string) error {
+	var userID int
+	var familyID string
+	err := db.QueryRow(`
+		SELECT user_id, family_id FROM refresh_tokens
+		WHERE token_hash = ?`, hashToken(token)).Scan(&userID, &familyID)
+	if err != nil {
+		return err
+	}
+	return revokeSession(userID, familyID)
+}
+
+// Revoke every session of a user except the given one
+func revokeOtherSessions(userID int, keepID string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", userID, keepID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		DELETE FROM refresh_tokens
+		WHERE user_id = ? AND family_id IS NOT ?`, userID, keepID)
+	return err
+}
+
+// Revoke every session of a user, along with all access tokens issued so far
+func revokeUserSessions(userID int) error {
+	if err := revokeOtherSessions(userID, ""); err != nil {
+		return err
+	}
+	return revokeUserTokens(userID)
+}
+
+func newSessionResponse(session Session, currentID string) SessionResponse {
+	return SessionResponse{
+		ID:         session.ID,
+		UserAgent:  session.UserAgent,
+		IP:         session.IP,
+		CreatedAt:  session.CreatedAt,
+		LastUsedAt: session.LastUsedAt,
+		ExpiresAt:  session.ExpiresAt.UTC().Format(time.RFC3339),
+		Current:    session.ID == currentID,
+	}
+}
+
+// GET /user/sessions
+// List sessions of the current user
+// @Summary		List own sessions
+// @Description	List the devices the current user is logged in on
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Success		200				{object}	SessionsListResponse
+// @Failure		500				{object}	ErrorResponse	"Failed to fetch sessions"
+// @Router			/user/sessions [GET]
+func getSessionsHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	currentID, _ := c.Locals("sessionID").(string)
+
+	sessions, err := getUserSessions(userID)
+	if err != nil {
+		log.Warnf("Failed to get sessions of user %d: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch sessions",
+		})
+	}
+
+	response := SessionsListResponse{Sessions: []SessionResponse{}}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, newSessionResponse(session, currentID))
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// DELETE /user/sessions/:id
+// Revoke a session of the current user
+// @Summary		Revoke own session
+// @Description	Sign the current user out of one session
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			id	path		string	true	"Session ID"
+// @Success		200	{object}	SuccessResponse	"Session revoked message"
+// @Failure		404	{object}	ErrorResponse	"Session not found"
+// @Failure		500	{object}	ErrorResponse	"Failed to revoke session"
+// @Router			/user/sessions/{id} [DELETE]
+func revokeSessionHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	if err := revokeSession(userID, c.Params("id")); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "Session not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to revoke session",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Session revoked successfully",
+	})
+}
+
+// DELETE /user/sessions
+// Revoke all other sessions of the current user
+// @Summary		Sign out everywhere else
+// @Description	Revoke every session of the current user except the one making the request
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Success		200	{object}	SuccessResponse	"Sessions revoked message"
+// @Failure		500	{object}	ErrorResponse	"Failed to revoke sessions"
+// @Router			/user/sessions [DELETE]
+func revokeOtherSessionsHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+	currentID, _ := c.Locals("sessionID").(string)
+
+	if err := revokeOtherSessions(userID, currentID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to revoke sessions",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Other sessions revoked successfully",
+	})
+}
+
+// GET /admin/users/:id/sessions
+// List sessions of a user (admin only)
+// @Summary		List user sessions
+// @Description	List the devices a user is logged in on (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			id	path		int	true	"User ID"
+// @Success		200	{object}	SessionsListResponse
+// @Failure		400	{object}	ErrorResponse	"Invalid user ID"
+// @Failure		500	{object}	ErrorResponse	"Failed to fetch sessions"
+// @Router			/admin/users/{id}/sessions [GET]
+func getUserSessionsHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid user ID",
+		})
+	}
+	currentID, _ := c.Locals("sessionID").(string)
+
+	sessions, err := getUserSessions(id)
+	if err != nil {
+		log.Warnf("Failed to get sessions of user %d: %v", id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch sessions",
+		})
+	}
+
+	response := SessionsListResponse{Sessions: []SessionResponse{}}
+	for _, session := range sessions {
+		response.Sessions = append(response.Sessions, newSessionResponse(session, currentID))
+	}
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// DELETE /admin/users/:id/sessions
+// Revoke all sessions of a user (admin only)
+// @Summary		Revoke user sessions
+// @Description	Sign a user out of every session and revoke their refresh tokens (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			id	path		int	true	"User ID"
+// @Success		200	{object}	SuccessResponse	"Sessions revoked message"
+// @Failure		400	{object}	ErrorResponse	"Invalid user ID"
+// @Failure		500	{object}	ErrorResponse	"Failed to revoke sessions"
+// @Router			/admin/users/{id}/sessions [DELETE]
+func revokeUserSessionsHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid user ID",
+		})
+	}
+
+	if err := revokeUserSessions(id); err != nil {
+		log.Warnf("Failed to revoke sessions of user %d: %v", id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to revoke sessions",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Sessions revoked successfully",
+	})
+}
+
+// DELETE /admin/users/:id/sessions/:sid
+// Revoke a session of a user (admin only)
+// @Summary		Revoke user session
+// @Description	Sign a user out of one session (admin only)
+// @Tags			admin
+// @Accept			json
+// @Produce		json
+// @Param			id	path		int		true	"User ID"
+// @Param			sid	path		string	true	"Session ID"
+// @Success		200	{object}	SuccessResponse	"Session revoked message"
+// @Failure		400	{object}	ErrorResponse	"Invalid user ID"
+// @Failure		404	{object}	ErrorResponse	"Session not found"
+// @Failure		500	{object}	ErrorResponse	"Failed to revoke session"
+// @Router			/admin/users/{id}/sessions/{sid} [DELETE]
+func revokeUserSessionHandler(c *fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid user ID",
+		})
+	}
+
+	if err := revokeSession(id, c.Params("sid")); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "Session not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to revoke session",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Session revoked successfully",
+	})
+}
@@ -8,6 +8,7 @@ import { Error404 } from './routes/sessions/error-404';
 import { Error500 } from './routes/sessions/error-500';
 import { Login } from './routes/sessions/login/login';
 import { Register } from './routes/sessions/register/register';
+import { ResetPassword } from './routes/sessions/reset-password/reset-password';
 
 export const routes: Routes = [
   {
@@ -61,6 +62,7 @@ export const routes: Routes = [
     children: [
       { path: 'login', component: Login },
       { path: 'register', component: Register },
+      { path: 'reset-password', component: ResetPassword },
     ],
   },
   { path: '**', redirectTo: 'dashboard' },
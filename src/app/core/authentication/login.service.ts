@@ -19,6 +19,10 @@ export class LoginService {
     return this.http.post<Token>('/auth/refresh', params);
   }
 
+  resetPassword(token: string, password: string) {
+    return this.http.post<any>('/auth/reset-password', { token, password });
+  }
+
   logout() {
     return this.http.post<any>('/auth/logout', {});
   }
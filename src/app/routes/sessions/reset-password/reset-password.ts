@@ -0,0 +1,100 @@
+import { HttpErrorResponse } from '@angular/common/http';
+import { Component, inject } from '@angular/core';
+import {
+  AbstractControl,
+  FormBuilder,
+  FormsModule,
+  ReactiveFormsModule,
+  Validators,
+} from '@angular/forms';
+import { MatButtonModule } from '@angular/material/button';
+import { MatCardModule } from '@angular/material/card';
+import { MatFormFieldModule } from '@angular/material/form-field';
+import { MatInputModule } from '@angular/material/input';
+import { ActivatedRoute, Router, RouterLink } from '@angular/router';
+import { MtxButtonModule } from '@ng-matero/extensions/button';
+import { TranslateModule } from '@ngx-translate/core';
+
+import { LoginService } from '@core/authentication';
+
+@Component({
+  selector: 'app-reset-password',
+  templateUrl: './reset-password.html',
+  styleUrl: './reset-password.scss',
+  imports: [
+    RouterLink,
+    FormsModule,
+    ReactiveFormsModule,
+    MatButtonModule,
+    MatCardModule,
+    MatFormFieldModule,
+    MatInputModule,
+    MtxButtonModule,
+    TranslateModule,
+  ],
+})
+export class ResetPassword {
+  private readonly fb = inject(FormBuilder);
+  private readonly router = inject(Router);
+  private readonly loginService = inject(LoginService);
+
+  // The token comes from the link in the password reset email
+  readonly token = inject(ActivatedRoute).snapshot.queryParamMap.get('token') ?? '';
+
+  isSubmitting = false;
+  errors: string[] = [];
+
+  resetForm = this.fb.nonNullable.group(
+    {
+      password: ['', [Validators.required]],
+      confirmPassword: ['', [Validators.required]],
+    },
+    {
+      validators: [this.matchValidator('password', 'confirmPassword')],
+    }
+  );
+
+  get password() {
+    return this.resetForm.get('password')!;
+  }
+
+  get confirmPassword() {
+    return this.resetForm.get('confirmPassword')!;
+  }
+
+  matchValidator(source: string, target: string) {
+    return (control: AbstractControl) => {
+      const sourceControl = control.get(source)!;
+      const targetControl = control.get(target)!;
+      if (targetControl.errors && !targetControl.errors.mismatch) {
+        return null;
+      }
+      if (sourceControl.value !== targetControl.value) {
+        targetControl.setErrors({ mismatch: true });
+        return { mismatch: true };
+      } else {
+        targetControl.setErrors(null);
+        return null;
+      }
+    };
+  }
+
+  resetPassword() {
+    this.isSubmitting = true;
+    this.errors = [];
+
+    this.loginService.resetPassword(this.token, this.password.value).subscribe({
+      next: () => {
+        this.router.navigateByUrl('/auth/login');
+      },
+      error: (errorRes: HttpErrorResponse) => {
+        // Policy violations list every rule the password breaks
+        const violations: { message: string }[] = errorRes.error?.violations ?? [];
+        this.errors = violations.length
+          ? violations.map(violation => violation.message)
+          : [errorRes.error?.error ?? errorRes.message];
+        this.isSubmitting = false;
+      },
+    });
+  }
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// How long users loaded for authentication are cached
+const userCacheTTL = 10 * time.Second
+
+type cachedUser struct {
+	user      *User
+	expiresAt time.Time
+}
+
+// In-process cache of users checked by strict authentication
+var userCache = struct {
+	sync.Mutex
+	users map[int]cachedUser
+}{users: map[int]cachedUser{}}
+
+// Get a user by ID, served from the cache while it is fresh
+func getCachedUser(id int) (*User, error) {
+	userCache.Lock()
+	entry, ok := userCache.users[id]
+	userCache.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.user, nil
+	}
+
+	user, err := getUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	userCache.Lock()
+	userCache.users[id] = cachedUser{user: user, expiresAt: time.Now().Add(userCacheTTL)}
+	userCache.Unlock()
+	return user, nil
+}
+
+// Drop a user from the cache after it changed
+func invalidateCachedUser(id int) {
+	userCache.Lock()
+	delete(userCache.users, id)
+	userCache.Unlock()
+}
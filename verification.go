@@ -0,0 +1,224 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// How long an email verification link stays valid
+const emailVerificationTTL = 24 * time.Hour
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email"`
+}
+
+// Create a verification token for the user's current email, replacing older ones
+func createEmailVerificationToken(userID int, email string) (string, error) {
+	token, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = ?", userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO email_verification_tokens (user_id, email, token_hash, expires_at)
+		VALUES (?, ?, ?, ?)`, userID, email, hashToken(token), time.Now().Add(emailVerificationTTL))
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+// Mark the email a token was issued for as verified. Tokens are single use and
+// stop working when the user's email changed after they were issued.
+func verifyEmailToken(token string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var email string
+	var expiresAt time.Time
+	err = tx.QueryRow(`
+		SELECT user_id, email, expires_at
+		FROM email_verification_tokens
+		WHERE token_hash = ?`, hashToken(token)).Scan(&userID, &email, &expiresAt)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("DELETE FROM email_verification_tokens WHERE user_id = ?", userID); err != nil {
+		return 0, err
+	}
+
+	if time.Now().After(expiresAt) {
+		// Token expired, keep it deleted
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, sql.ErrNoRows
+	}
+
+	result, err := tx.Exec(`
+		UPDATE users SET email_verified_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND email = ?`, userID, email)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Email changed since the token was issued, keep it deleted
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+		return 0, sql.ErrNoRows
+	}
+
+	return userID, tx.Commit()
+}
+
+// Email a verification link for the user's current email address
+func sendVerificationEmail(user *User) error {
+	token, err := createEmailVerificationToken(user.ID, user.Email)
+	if err != nil {
+		return err
+	}
+
+	link := settings.PublicURL + "/auth/verify-email?token=" + url.QueryEscape(token)
+	return sendMail(MailMessage{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"Please confirm your email address by opening the link below:\n\n%s\n\n"+
+			"The link expires in %d hours. If you did not request this, you can ignore this email.\n",
+			user.Name, link, int(emailVerificationTTL.Hours())),
+	})
+}
+
+// Send a verification email, logging instead of failing the calling request
+func sendVerificationEmailIfUnverified(user *User) {
+	if user.EmailVerifiedAt != nil {
+		return
+	}
+	if err := sendVerificationEmail(user); err != nil {
+		log.Warnf("Failed to send verification email to user %d: %v", user.ID, err)
+	}
+}
+
+// Send a verification email in the background, so a slow mail server does
+// not hold up the calling request
+func requestEmailVerification(user *User) {
+	if user.EmailVerifiedAt != nil {
+		return
+	}
+	enqueueMailJob(func() {
+		sendVerificationEmailIfUnverified(user)
+	})
+}
+
+// GET, POST /auth/verify-email
+// Verify email godoc
+//
+//	@Summary		Verify email
+//	@Description	Verify a user's email address with the token sent by email. The token can be given as query parameter or in the body.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			token				query		string				false	"Verification token"
+//	@Param			verifyEmailRequest	body		VerifyEmailRequest	false	"Verification token"
+//	@Success		200					{object}	SuccessResponse	"Email verified message"
+//	@Failure		400					{object}	ErrorResponse	"Missing, invalid or expired token"
+//	@Failure		500					{object}	ErrorResponse	"Failed to verify email"
+//	@Router			/auth/verify-email [POST]
+func verifyEmailHandler(c *fiber.Ctx) error {
+	req := VerifyEmailRequest{Token: c.Query("token")}
+	if req.Token == "" && c.Method() == fiber.MethodPost {
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+				Error: "Invalid request body",
+			})
+		}
+	}
+
+	if req.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Token is required",
+		})
+	}
+
+	if _, err := verifyEmailToken(req.Token); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+				Error: "Invalid or expired token",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to verify email",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Email verified successfully",
+	})
+}
+
+// POST /auth/verify-email/resend
+// Resend verification email godoc
+//
+//	@Summary		Resend verification email
+//	@Description	Send a new verification link if the address belongs to an unverified account. The response does not reveal whether it does.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			resendVerificationRequest	body		ResendVerificationRequest	true	"Email address"
+//	@Success		200							{object}	SuccessResponse	"Verification email sent message"
+//	@Failure		400							{object}	ErrorResponse	"Invalid request body or missing email"
+//	@Router			/auth/verify-email/resend [POST]
+func resendVerificationHandler(c *fiber.Ctx) error {
+	var req ResendVerificationRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if req.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Email is required",
+		})
+	}
+
+	// Look up the user and send the mail in the background, so the response
+	// time does not reveal whether the address belongs to an unverified account
+	email := req.Email
+	enqueueMailJob(func() {
+		user, err := getUserByEmail(email)
+		if err == nil && user.Status != "disabled" {
+			sendVerificationEmailIfUnverified(user)
+		} else if err != nil && err != sql.ErrNoRows {
+			log.Warnf("Failed to get user by email: %v", err)
+		}
+	})
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "If the address belongs to an unverified account, a verification email has been sent",
+	})
+}
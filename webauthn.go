@@ -0,0 +1,605 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/log"
+)
+
+// How long a registration or login ceremony can take
+const webAuthnCeremonyTTL = 5 * time.Minute
+
+// Longest accepted passkey name
+const maxPasskeyNameLength = 64
+
+// WebAuthn relying party, set up at startup by newWebAuthn
+var webAuthn *webauthn.WebAuthn
+
+// A started registration or login ceremony, kept until it is finished
+type webAuthnCeremony struct {
+	UserID    int // Zero for passwordless logins, the user is known after the assertion
+	Session   webauthn.SessionData
+	ExpiresAt time.Time
+}
+
+// Ceremonies in progress by ID
+var webAuthnCeremonies = struct {
+	sync.Mutex
+	ceremonies map[string]webAuthnCeremony
+}{ceremonies: map[string]webAuthnCeremony{}}
+
+// User with their credentials, as seen by the WebAuthn library
+type webAuthnUser struct {
+	user        *User
+	credentials []webauthn.Credential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte                         { return []byte(strconv.Itoa(u.user.ID)) }
+func (u *webAuthnUser) WebAuthnName() string                       { return u.user.Username }
+func (u *webAuthnUser) WebAuthnDisplayName() string                { return u.user.Name }
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+type WebAuthnBeginResponse struct {
+	SessionID string      `json:"session_id"` // Passed back when finishing the ceremony
+	Options   interface{} `json:"options"`    // Options for navigator.credentials.create() or get()
+}
+
+// Registering a passkey requires confirming the current password or a TOTP code
+type WebAuthnRegisterBeginRequest struct {
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"` // TOTP code, instead of the password
+}
+
+type WebAuthnRegisterRequest struct {
+	SessionID  string          `json:"session_id"`
+	Name       string          `json:"name,omitempty"` // Label of the passkey, e.g. the device
+	Credential json.RawMessage `json:"credential" swaggertype:"object"`
+}
+
+type WebAuthnLoginRequest struct {
+	SessionID  string          `json:"session_id"`
+	Credential json.RawMessage `json:"credential" swaggertype:"object"`
+	RememberMe bool            `json:"rememberMe"`
+}
+
+type PasskeyResponse struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at"`
+}
+
+type PasskeysListResponse struct {
+	Passkeys []PasskeyResponse `json:"passkeys"`
+}
+
+// Create the WebAuthn relying party for the public URL
+func newWebAuthn() (*webauthn.WebAuthn, error) {
+	rpID := settings.WebAuthnRPID
+	if rpID == "" {
+		publicURL, err := url.Parse(settings.PublicURL)
+		if err != nil {
+			return nil, err
+		}
+		rpID = publicURL.Hostname()
+	}
+
+	origins := settings.WebAuthnOrigins
+	if len(origins) == 0 {
+		origins = []string{settings.PublicURL}
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: totpIssuer,
+		RPOrigins:     origins,
+	})
+}
+
+// Remember a started ceremony and return its ID
+func startWebAuthnCeremony(userID int, session *webauthn.SessionData) (string, error) {
+	id, err := generateOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	webAuthnCeremonies.Lock()
+	defer webAuthnCeremonies.Unlock()
+	for key, ceremony := range webAuthnCeremonies.ceremonies {
+		if time.Now().After(ceremony.ExpiresAt) {
+			delete(webAuthnCeremonies.ceremonies, key)
+		}
+	}
+	webAuthnCeremonies.ceremonies[id] = webAuthnCeremony{
+		UserID:    userID,
+		Session:   *session,
+		ExpiresAt: time.Now().Add(webAuthnCeremonyTTL),
+	}
+	return id, nil
+}
+
+// Take a started ceremony, each ceremony can only be finished once
+func takeWebAuthnCeremony(id string) (webAuthnCeremony, bool) {
+	webAuthnCeremonies.Lock()
+	defer webAuthnCeremonies.Unlock()
+	ceremony, ok := webAuthnCeremonies.ceremonies[id]
+	delete(webAuthnCeremonies.ceremonies, id)
+	if !ok || time.Now().After(ceremony.ExpiresAt) {
+		return webAuthnCeremony{}, false
+	}
+	return ceremony, true
+}
+
+// Load a user together with their WebAuthn credentials
+func getWebAuthnUser(user *User) (*webAuthnUser, error) {
+	rows, err := db.Query("SELECT credential FROM webauthn_credentials WHERE user_id = ?", user.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	waUser := &webAuthnUser{user: user}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var credential webauthn.Credential
+		if err := json.Unmarshal([]byte(data), &credential); err != nil {
+			return nil, err
+		}
+		waUser.credentials = append(waUser.credentials, credential)
+	}
+	return waUser, rows.Err()
+}
+
+func saveWebAuthnCredential(userID int, name string, credential *webauthn.Credential) (*PasskeyResponse, error) {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return nil, err
+	}
+
+	var passkey PasskeyResponse
+	err = db.QueryRow(`
+		INSERT INTO webauthn_credentials (user_id, credential_id, name, credential)
+		VALUES (?, ?, ?, ?)
+		RETURNING id, name, created_at, last_used_at`,
+		userID, base64.RawURLEncoding.EncodeToString(credential.ID), name, string(data),
+	).Scan(&passkey.ID, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+// Store the updated sign counter of a credential after a login
+func updateWebAuthnCredential(credential *webauthn.Credential) error {
+	data, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`
+		UPDATE webauthn_credentials SET credential = ?, last_used_at = CURRENT_TIMESTAMP
+		WHERE credential_id = ?`, string(data), base64.RawURLEncoding.EncodeToString(credential.ID))
+	return err
+}
+
+func getPasskeys(userID int) ([]PasskeyResponse, error) {
+	rows, err := db.Query(`
+		SELECT id, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = ?
+		ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []PasskeyResponse{}
+	for rows.Next() {
+		var passkey PasskeyResponse
+		if err := rows.Scan(&passkey.ID, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt); err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, rows.Err()
+}
+
+func deletePasskey(userID int, id int) error {
+	result, err := db.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Remove every passkey of a user
+func deleteUserPasskeys(userID int) error {
+	_, err := db.Exec("DELETE FROM webauthn_credentials WHERE user_id = ?", userID)
+	return err
+}
+
+// Email a user that a passkey was added to their account
+func sendPasskeyRegisteredEmail(user *User, name string) error {
+	return sendMail(MailMessage{
+		To:      user.Email,
+		Subject: "A passkey was added to your account",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"The passkey %q was added to your account %s and can now be used to log in.\n\n"+
+			"If you did not add it, remove it from your account and change your password right away.\n",
+			user.Name, name, user.Username),
+	})
+}
+
+// POST /user/webauthn/register/begin
+// Start passkey registration of the current user
+// @Summary		Begin passkey registration
+// @Description	Get the options for navigator.credentials.create() to register a passkey for the current user, after confirming the current password or a TOTP code
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			webAuthnRegisterBeginRequest	body		WebAuthnRegisterBeginRequest	true	"Current password or TOTP code"
+// @Success		200								{object}	WebAuthnBeginResponse
+// @Failure		400								{object}	ErrorResponse	"Invalid request body or missing password and code"
+// @Failure		401								{object}	ErrorResponse	"Password or code is incorrect"
+// @Failure		500								{object}	ErrorResponse	"Failed to start passkey registration"
+// @Router			/user/webauthn/register/begin [POST]
+func beginPasskeyRegistrationHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req WebAuthnRegisterBeginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	// A passkey logs in without password or second factor, so a stolen access
+	// token alone must not be enough to add one. The registration can only be
+	// finished with the ceremony started here.
+	switch {
+	case req.Password != "":
+		if err := verifyUserPassword(userID, req.Password); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(ErrorResponse{
+				Error: "Password is incorrect",
+			})
+		}
+	case req.Code != "":
+		ok, err := verifyTOTP(userID, req.Code)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+				Error: "Failed to start passkey registration",
+			})
+		}
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(ErrorResponse{
+				Error: "Invalid code",
+			})
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Password or code is required",
+		})
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to start passkey registration",
+		})
+	}
+	waUser, err := getWebAuthnUser(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to start passkey registration",
+		})
+	}
+
+	// Discoverable credentials with user verification allow passwordless login
+	var exclusions []protocol.CredentialDescriptor
+	for _, credential := range waUser.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	creation, session, err := webAuthn.BeginRegistration(waUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationRequired,
+		}),
+	)
+	if err != nil {
+		log.Warnf("Failed to begin passkey registration of user %d: %v", userID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to start passkey registration",
+		})
+	}
+
+	sessionID, err := startWebAuthnCeremony(userID, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to start passkey registration",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(WebAuthnBeginResponse{
+		SessionID: sessionID,
+		Options:   creation,
+	})
+}
+
+// POST /user/webauthn/register/finish
+// Finish passkey registration of the current user
+// @Summary		Finish passkey registration
+// @Description	Register the passkey created by navigator.credentials.create()
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			webAuthnRegisterRequest	body		WebAuthnRegisterRequest	true	"Ceremony and created credential"
+// @Success		201						{object}	PasskeyResponse
+// @Failure		400						{object}	ErrorResponse	"Invalid request body, unknown ceremony or invalid credential"
+// @Failure		409						{object}	ErrorResponse	"Passkey already registered"
+// @Failure		500						{object}	ErrorResponse	"Failed to register passkey"
+// @Router			/user/webauthn/register/finish [POST]
+func finishPasskeyRegistrationHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	var req WebAuthnRegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid request body",
+		})
+	}
+
+	if len(req.Name) > maxPasskeyNameLength {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: fmt.Sprintf("Name must be at most %d characters", maxPasskeyNameLength),
+		})
+	}
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+
+	ceremony, ok := takeWebAuthnCeremony(req.SessionID)
+	if !ok || ceremony.UserID != userID {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Unknown or expired registration",
+		})
+	}
+
+	user, err := getUserByID(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to register passkey",
+		})
+	}
+	waUser, err := getWebAuthnUser(user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to register passkey",
+		})
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBytes(req.Credential)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid credential",
+		})
+	}
+	credential, err := webAuthn.CreateCredential(waUser, ceremony.Session, parsed)
+	if err != nil {
+		log.Warnf("Failed to verify passkey of user %d: %v", userID, err)
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid credential",
+		})
+	}
+
+	passkey, err := saveWebAuthnCredential(userID, req.Name, credential)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return c.Status(fiber.StatusConflict).JSON(ErrorResponse{
+				Error: "Passkey already registered",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to register passkey",
+		})
+	}
+	logRequestSecurityEvent(c, "passkey_registered", userID, "registered passkey "+req.Name)
+
+	// Tell the user, in case someone else added the passkey
+	enqueueMailJob(func() {
+		if err := sendPasskeyRegisteredEmail(user, passkey.Name); err != nil {
+			log.Warnf("Failed to send passkey notification to user %d: %v", userID, err)
+		}
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(passkey)
+}
+
+// GET /user/webauthn/credentials
+// List passkeys of the current user
+// @Summary		List passkeys
+// @Description	List the passkeys registered by the current user
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Success		200	{object}	PasskeysListResponse
+// @Failure		500	{object}	ErrorResponse	"Failed to fetch passkeys"
+// @Router			/user/webauthn/credentials [GET]
+func getPasskeysHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	passkeys, err := getPasskeys(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to fetch passkeys",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(PasskeysListResponse{
+		Passkeys: passkeys,
+	})
+}
+
+// DELETE /user/webauthn/credentials/:id
+// Remove a passkey of the current user
+// @Summary		Remove passkey
+// @Description	Remove a passkey of the current user
+// @Tags			user
+// @Accept			json
+// @Produce		json
+// @Param			id	path		int	true	"Passkey ID"
+// @Success		200	{object}	SuccessResponse	"Passkey removed message"
+// @Failure		400	{object}	ErrorResponse	"Invalid passkey ID"
+// @Failure		404	{object}	ErrorResponse	"Passkey not found"
+// @Failure		500	{object}	ErrorResponse	"Failed to remove passkey"
+// @Router			/user/webauthn/credentials/{id} [DELETE]
+func deletePasskeyHandler(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(int)
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(ErrorResponse{
+			Error: "Invalid passkey ID",
+		})
+	}
+
+	if err := deletePasskey(userID, id); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Status(fiber.StatusNotFound).JSON(ErrorResponse{
+				Error: "Passkey not found",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(ErrorResponse{
+			Error: "Failed to remove passkey",
+		})
+	}
+	logRequestSecurityEvent(c, "passkey_removed", userID, fmt.Sprintf("removed passkey %d", id))
+
+	return c.Status(fiber.StatusOK).JSON(SuccessResponse{
+		Message: "Passkey removed successfully",
+	})
+}
+
+// POST /auth/webauthn/login/begin
+// Begin passkey login godoc
+//
+//	@Summary		Begin passkey login
+//	@Description	Get the options for navigator.credentials.get() to log in with a passkey, without username or password
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Success		200	{object}	WebAuthnBeginResponse
+//	@Failure		500	{object}	ErrorResponse	"Failed to start passkey login"
+//	@Router			/auth/webauthn/login/begin [POST]
+func beginPasskeyLoginHandler(c *fiber.Ctx) error {
+	assertion, session, err := webAuthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+	)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey login",
+		})
+	}
+
+	sessionID, err := startWebAuthnCeremony(0, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start passkey login",
+		})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(WebAuthnBeginResponse{
+		SessionID: sessionID,
+		Options:   assertion,
+	})
+}
+
+// POST /auth/webauthn/login
+// Passkey login godoc
+//
+//	@Summary		Passkey login
+//	@Description	Log in with the assertion returned by navigator.credentials.get(). Returns the same tokens as /auth/login; a passkey counts as two-factor authentication.
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			webAuthnLoginRequest	body		WebAuthnLoginRequest	true	"Ceremony and assertion"
+//	@Success		200						{object}	Token
+//	@Failure		400						{object}	ErrorResponse	"Invalid request body"
+//	@Failure		401						{object}	ErrorResponse	"Invalid passkey"
+//	@Failure		500						{object}	ErrorResponse	"Internal server error"
+//	@Router			/auth/webauthn/login [POST]
+func passkeyLoginHandler(c *fiber.Ctx) error {
+	var req WebAuthnLoginRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	ceremony, ok := takeWebAuthnCeremony(req.SessionID)
+	if !ok || ceremony.UserID != 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Unknown or expired login",
+		})
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBytes(req.Credential)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid credential",
+		})
+	}
+
+	// The user handle of a discoverable credential is the user ID
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		id, err := strconv.Atoi(string(userHandle))
+		if err != nil {
+			return nil, err
+		}
+		user, err := getUserByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if user.Status != "active" {
+			return nil, fmt.Errorf("user %d is not active", id)
+		}
+		return getWebAuthnUser(user)
+	}
+	waUser, credential, err := webAuthn.ValidatePasskeyLogin(findUser, ceremony.Session, parsed)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid passkey",
+		})
+	}
+	user := waUser.(*webAuthnUser).user
+
+	// A sign counter that went backwards means the authenticator was cloned
+	if credential.Authenticator.CloneWarning {
+		logRequestSecurityEvent(c, "passkey_clone_warning", user.ID, "sign counter did not increase")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid passkey",
+		})
+	}
+	if err := updateWebAuthnCredential(credential); err != nil {
+		log.Warnf("Failed to update passkey of user %d: %v", user.ID, err)
+	}
+
+	return completeLogin(c, user, req.RememberMe, true)
+}
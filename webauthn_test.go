@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testPublicURL = "http://localhost:8080"
+
+var testApp *fiber.App
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "webadmin-test")
+	if err != nil {
+		panic(err)
+	}
+
+	settings = Settings{
+		PublicURL:              testPublicURL,
+		JWTAlgorithm:           "HS256",
+		JWTIssuer:              testPublicURL,
+		JWTAudience:            "webadmin",
+		AccessTokenTTL:         time.Hour,
+		RefreshTokenTTL:        24 * time.Hour,
+		RememberMeTTL:          24 * time.Hour,
+		PasswordMinLength:      8,
+		BreachedPasswordAction: "reject",
+	}
+	jwt.TimePrecision = time.Millisecond
+	if err := initDatabase(filepath.Join(dir, "test.db")); err != nil {
+		panic(err)
+	}
+	keyring = &Keyring{Keys: map[string]*SigningKey{}}
+	keyring.Current = hmacKey("test", "test-secret-that-is-long-enough-to-use")
+	keyring.Keys[keyring.Current.ID] = keyring.Current
+	if webAuthn, err = newWebAuthn(); err != nil {
+		panic(err)
+	}
+
+	testApp = fiber.New()
+	setupRoutes(testApp)
+
+	code := m.Run()
+	db.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Send a JSON request to the test app and decode the JSON response
+func testRequest(t *testing.T, path string, token string, body interface{}) (int, map[string]interface{}) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(fiber.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	if token != "" {
+		req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	}
+	resp, err := testApp.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result map[string]interface{}
+	if err := json.Unmarshal(out, &result); err != nil {
+		t.Fatalf("%s returned invalid JSON %q", path, out)
+	}
+	return resp.StatusCode, result
+}
+
+func testLogin(t *testing.T, username string, password string) string {
+	t.Helper()
+	status, body := testRequest(t, "/auth/login", "", LoginRequest{Username: username, Password: password})
+	if status != fiber.StatusOK {
+		t.Fatalf("login as %s: status %d: %v", username, status, body)
+	}
+	return body["access_token"].(string)
+}
+
+// Software authenticator with a single ES256 passkey, using "none" attestation
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentialID := make([]byte, 16)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+var b64 = base64.RawURLEncoding
+
+// Public key options of a begin response
+func publicKeyOptions(t *testing.T, begin map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	options, ok := begin["options"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("begin response without options: %v", begin)
+	}
+	return options["publicKey"].(map[string]interface{})
+}
+
+func (a *softAuthenticator) clientData(t *testing.T, ceremony string, challenge interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]interface{}{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testPublicURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte) *bytes.Buffer {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	var data bytes.Buffer
+	data.Write(rpIDHash[:])
+	data.WriteByte(flags)
+	binary.Write(&data, binary.BigEndian, a.signCount)
+	return &data
+}
+
+// Create the passkey for navigator.credentials.create() options
+func (a *softAuthenticator) create(t *testing.T, options map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	user := options["user"].(map[string]interface{})
+	userHandle, err := b64.DecodeString(user["id"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.userHandle = userHandle
+
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// User present, user verified, attested credential data
+	authData := a.authenticatorData(0x45)
+	authData.Write(make([]byte, 16)) // AAGUID
+	binary.Write(authData, binary.BigEndian, uint16(len(a.credentialID)))
+	authData.Write(a.credentialID)
+	authData.Write(coseKey)
+
+	attestation, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData.Bytes(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(a.clientData(t, "webauthn.create", options["challenge"])),
+			"attestationObject": b64.EncodeToString(attestation),
+		},
+	}
+}
+
+// Sign an assertion for navigator.credentials.get() options with the given sign counter
+func (a *softAuthenticator) get(t *testing.T, options map[string]interface{}, signCount uint32) map[string]interface{} {
+	t.Helper()
+	a.signCount = signCount
+	clientData := a.clientData(t, "webauthn.get", options["challenge"])
+	// User present, user verified
+	authData := a.authenticatorData(0x05).Bytes()
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]interface{}{
+		"id":    b64.EncodeToString(a.credentialID),
+		"rawId": b64.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(a.userHandle),
+		},
+	}
+}
+
+// Register a new passkey for the default user
+func registerPasskey(t *testing.T) *softAuthenticator {
+	t.Helper()
+	token := testLogin(t, "user", "userpwd")
+	authenticator := newSoftAuthenticator(t)
+
+	status, begin := testRequest(t, "/user/webauthn/register/begin", token, WebAuthnRegisterBeginRequest{Password: "userpwd"})
+	if status != fiber.StatusOK {
+		t.Fatalf("begin registration: status %d: %v", status, begin)
+	}
+	status, body := testRequest(t, "/user/webauthn/register/finish", token, map[string]interface{}{
+		"session_id": begin["session_id"],
+		"name":       "Soft key",
+		"credential": authenticator.create(t, publicKeyOptions(t, begin)),
+	})
+	if status != fiber.StatusCreated {
+		t.Fatalf("finish registration: status %d: %v", status, body)
+	}
+	return authenticator
+}
+
+// Log in with a passkey, returning the status and response of the login
+func passkeyLogin(t *testing.T, authenticator *softAuthenticator, signCount uint32) (int, map[string]interface{}) {
+	t.Helper()
+	status, begin := testRequest(t, "/auth/webauthn/login/begin", "", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("begin login: status %d: %v", status, begin)
+	}
+	return testRequest(t, "/auth/webauthn/login", "", map[string]interface{}{
+		"session_id": begin["session_id"],
+		"credential": authenticator.get(t, publicKeyOptions(t, begin), signCount),
+		"rememberMe": true,
+	})
+}
+
+func TestPasskeyRegistration(t *testing.T) {
+	token := testLogin(t, "user", "userpwd")
+
+	status, body := testRequest(t, "/user/webauthn/register/begin", token, WebAuthnRegisterBeginRequest{})
+	if status != fiber.StatusBadRequest {
+		t.Errorf("begin registration without password: got status %d, want %d: %v", status, fiber.StatusBadRequest, body)
+	}
+	status, body = testRequest(t, "/user/webauthn/register/begin", token, WebAuthnRegisterBeginRequest{Password: "wrong"})
+	if status != fiber.StatusUnauthorized {
+		t.Errorf("begin registration with wrong password: got status %d, want %d: %v", status, fiber.StatusUnauthorized, body)
+	}
+
+	registerPasskey(t)
+
+	passkeys, err := getPasskeys(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(passkeys) == 0 || passkeys[len(passkeys)-1].Name != "Soft key" {
+		t.Errorf("registered passkey not listed: %v", passkeys)
+	}
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	authenticator := registerPasskey(t)
+
+	status, body := passkeyLogin(t, authenticator, 1)
+	if status != fiber.StatusOK {
+		t.Fatalf("passkey login: status %d: %v", status, body)
+	}
+	if body["token_type"] != "Bearer" {
+		t.Errorf("token_type = %v, want Bearer", body["token_type"])
+	}
+	if expiresIn, _ := body["expires_in"].(float64); expiresIn <= 0 {
+		t.Errorf("expires_in = %v, want a positive number", body["expires_in"])
+	}
+	if _, ok := body["scope"]; ok {
+		t.Errorf("passkey login returned restricted token of scope %v", body["scope"])
+	}
+	if refreshToken, _ := body["refresh_token"].(string); refreshToken == "" {
+		t.Error("remembered passkey login returned no refresh token")
+	}
+
+	claims, err := validateToken(body["access_token"].(string))
+	if err != nil {
+		t.Fatalf("invalid access token: %v", err)
+	}
+	if claims.Username != "user" || claims.SessionID == "" {
+		t.Errorf("access token for %q in session %q, want user with a session", claims.Username, claims.SessionID)
+	}
+}
+
+func TestPasskeyLoginRejectsReplayedSession(t *testing.T) {
+	authenticator := registerPasskey(t)
+
+	status, begin := testRequest(t, "/auth/webauthn/login/begin", "", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("begin login: status %d: %v", status, begin)
+	}
+	login := map[string]interface{}{
+		"session_id": begin["session_id"],
+		"credential": authenticator.get(t, publicKeyOptions(t, begin), 1),
+	}
+	if status, body := testRequest(t, "/auth/webauthn/login", "", login); status != fiber.StatusOK {
+		t.Fatalf("passkey login: status %d: %v", status, body)
+	}
+	if status, body := testRequest(t, "/auth/webauthn/login", "", login); status != fiber.StatusUnauthorized {
+		t.Errorf("replayed passkey login: got status %d, want %d: %v", status, fiber.StatusUnauthorized, body)
+	}
+}
+
+func TestPasskeyLoginRejectsExpiredSession(t *testing.T) {
+	authenticator := registerPasskey(t)
+
+	status, begin := testRequest(t, "/auth/webauthn/login/begin", "", nil)
+	if status != fiber.StatusOK {
+		t.Fatalf("begin login: status %d: %v", status, begin)
+	}
+	sessionID := begin["session_id"].(string)
+	webAuthnCeremonies.Lock()
+	ceremony := webAuthnCeremonies.ceremonies[sessionID]
+	ceremony.ExpiresAt = time.Now().Add(-time.Second)
+	webAuthnCeremonies.ceremonies[sessionID] = ceremony
+	webAuthnCeremonies.Unlock()
+
+	status, body := testRequest(t, "/auth/webauthn/login", "", map[string]interface{}{
+		"session_id": sessionID,
+		"credential": authenticator.get(t, publicKeyOptions(t, begin), 1),
+	})
+	if status != fiber.StatusUnauthorized {
+		t.Errorf("expired passkey login: got status %d, want %d: %v", status, fiber.StatusUnauthorized, body)
+	}
+}
+
+func TestPasskeyLoginRejectsCounterGoingBackwards(t *testing.T) {
+	authenticator := registerPasskey(t)
+
+	if status, body := passkeyLogin(t, authenticator, 5); status != fiber.StatusOK {
+		t.Fatalf("passkey login: status %d: %v", status, body)
+	}
+	status, body := passkeyLogin(t, authenticator, 3)
+	if status != fiber.StatusUnauthorized {
+		t.Errorf("passkey login with a lower sign counter: got status %d, want %d: %v", status, fiber.StatusUnauthorized, body)
+	}
+
+	events, _, err := getAuditEvents(2, "passkey_clone_warning", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 {
+		t.Error("no passkey_clone_warning audit event recorded")
+	}
+}